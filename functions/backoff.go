@@ -0,0 +1,35 @@
+package functions
+
+import (
+	"math"
+	"math/rand"
+	"time"
+)
+
+// Backoff computes retry delay with exponential backoff and jitter.
+type Backoff struct {
+	Base time.Duration
+	Cap  time.Duration
+}
+
+// Delay returns delay before the attempt. The first attempt (1) is delayed
+// around Base, and the delay is doubled for each attempt up to Cap. Half of
+// the delay is randomized (equal jitter) to spread retries of many objects
+// that failed at the same time.
+func (x Backoff) Delay(attempt int) time.Duration {
+	if x.Base <= 0 || attempt < 1 {
+		return 0
+	}
+
+	// Without Cap, doubling stops before overflow.
+	delay := x.Base
+	for i := 1; i < attempt && (x.Cap <= 0 || delay < x.Cap) && delay <= math.MaxInt64/2; i++ {
+		delay *= 2
+	}
+	if x.Cap > 0 && delay > x.Cap {
+		delay = x.Cap
+	}
+
+	half := delay / 2
+	return half + time.Duration(rand.Int63n(int64(half)+1))
+}
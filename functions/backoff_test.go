@@ -0,0 +1,45 @@
+package functions
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// assertDelay checks that delay of the attempt is in equal jitter range of
+// expected.
+func assertDelay(t *testing.T, backoff Backoff, attempt int, expected time.Duration) {
+	for i := 0; i < 100; i++ {
+		delay := backoff.Delay(attempt)
+		assert.True(t, expected/2 <= delay && delay <= expected,
+			"attempt %d: %s is out of [%s, %s]", attempt, delay, expected/2, expected)
+	}
+}
+
+func TestBackoffDelay(t *testing.T) {
+	backoff := Backoff{Base: 30 * time.Second, Cap: 5 * time.Minute}
+
+	assertDelay(t, backoff, 1, 30*time.Second)
+	assertDelay(t, backoff, 2, time.Minute)
+	assertDelay(t, backoff, 4, 4*time.Minute)
+	assertDelay(t, backoff, 5, 5*time.Minute)
+	assertDelay(t, backoff, 100, 5*time.Minute)
+}
+
+func TestBackoffDelayWithoutCap(t *testing.T) {
+	backoff := Backoff{Base: 30 * time.Second}
+
+	assertDelay(t, backoff, 1, 30*time.Second)
+	assertDelay(t, backoff, 5, 8*time.Minute)
+
+	// Doubling stops before overflow.
+	for _, attempt := range []int{64, 1000} {
+		assert.True(t, backoff.Delay(attempt) > 0)
+	}
+}
+
+func TestBackoffDelayDisabled(t *testing.T) {
+	assert.Equal(t, time.Duration(0), Backoff{}.Delay(3))
+	assert.Equal(t, time.Duration(0), Backoff{Base: time.Second}.Delay(0))
+}
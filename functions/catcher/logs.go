@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/cloudwatchlogs"
+	"github.com/pkg/errors"
+)
+
+// maxLogPages is a limit of pages to search log stream. A log group of busy
+// function can have a lot of events in the time range.
+const maxLogPages = 5
+
+// logGroupName returns CloudWatch Logs group name of Lambda function from ARN
+// such as "arn:aws:lambda:ap-northeast-1:1234567890:function:name:qualifier".
+func logGroupName(functionArn string) string {
+	parts := strings.Split(functionArn, ":")
+	if len(parts) < 7 || parts[5] != "function" {
+		return ""
+	}
+
+	return "/aws/lambda/" + parts[6]
+}
+
+// functionQualifier returns version or alias of Lambda function ARN. It
+// returns empty string for unqualified ARN.
+func functionQualifier(functionArn string) string {
+	parts := strings.Split(functionArn, ":")
+	if len(parts) < 8 {
+		return ""
+	}
+
+	return parts[7]
+}
+
+// logStreamFinder looks up log stream that has logs of the request ID.
+type logStreamFinder struct {
+	svc *cloudwatchlogs.CloudWatchLogs
+}
+
+func newLogStreamFinder(region string) *logStreamFinder {
+	ssn := session.Must(session.NewSession(&aws.Config{Region: aws.String(region)}))
+	return &logStreamFinder{svc: cloudwatchlogs.New(ssn)}
+}
+
+// Find returns name of log stream that has START log of the request. The
+// request should start before the failure occurred. It returns empty string
+// if not found.
+func (x *logStreamFinder) Find(ctx context.Context, logGroup, requestID string, occurredAt time.Time) (string, error) {
+	input := &cloudwatchlogs.FilterLogEventsInput{
+		LogGroupName:  aws.String(logGroup),
+		FilterPattern: aws.String(`"START RequestId: ` + requestID + `"`),
+		StartTime:     aws.Int64(occurredAt.Add(-15*time.Minute).Unix() * 1000),
+		EndTime:       aws.Int64(occurredAt.Add(time.Minute).Unix() * 1000),
+	}
+
+	var streamName string
+	pages := 0
+	err := x.svc.FilterLogEventsPagesWithContext(ctx, input,
+		func(output *cloudwatchlogs.FilterLogEventsOutput, lastPage bool) bool {
+			pages++
+			if len(output.Events) > 0 {
+				streamName = aws.StringValue(output.Events[0].LogStreamName)
+				return false
+			}
+			return pages < maxLogPages
+		})
+	if err != nil {
+		return "", errors.Wrap(err, "Fail to filter log events")
+	}
+
+	return streamName, nil
+}
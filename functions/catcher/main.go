@@ -4,15 +4,14 @@ import (
 	"context"
 	"encoding/json"
 	"os"
-	"time"
 
 	"github.com/aws/aws-lambda-go/events"
 	"github.com/aws/aws-lambda-go/lambda"
 	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/aws/session"
-	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/google/uuid"
 	"github.com/guregu/dynamo"
+	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
 
 	"github.com/m-mizutani/chamber/functions"
@@ -22,162 +21,600 @@ var logger = functions.NewLogger()
 
 // result is a returned value of Catcher Lambda function.
 type result struct {
-	Result string       `json:"result"`
-	Done   int          `json:"done"`
-	Errors []*errorInfo `json:"errors"`
+	Result            string                       `json:"result"`
+	Done              int                          `json:"done"`
+	Errors            []*errorInfo                 `json:"errors"`
+	BatchItemFailures []functions.BatchItemFailure `json:"batchItemFailures"`
 }
 
 // errorInfo is a pair of error and original S3 event.
 type errorInfo struct {
-	Error   error          `json:"error"`
-	S3Event events.S3Event `json:"s3event"`
+	MessageID string         `json:"message_id"`
+	Error     error          `json:"error"`
+	S3Event   events.S3Event `json:"s3event"`
+	// retryable is true if the message may be handled by retry.
+	retryable bool
 }
 
 // argment is a parameters to invoke Catcher
 type argument struct {
-	errorTable string
-	awsRegion  string
-	event      events.SNSEvent
+	errorTable        string
+	retryControlTable string
+	awsRegion         string
+	targetArn         string
+	lookupLogStream   bool
+	errorClassConfig  string
+	circuitConfig     *functions.CircuitConfig
+	messages          []dlqMessage
+	ctx               context.Context
 }
 
-// errorRecord is error information from Main Lambda, not from Catcher
-type errorRecord struct {
-	S3Key        string    `dynamo:"s3key"`
-	OccurredAt   time.Time `dynamo:"occurred_at"`
-	RequestID    string    `dynamo:"request_id"`
-	ErrorMessage string    `dynamo:"error_message"`
-	S3Event      []byte    `dynamo:"s3event"`
-	ErrorCount   int       `dynamo:"error_count"`
-	Retried      bool      `dynamo:"retried"`
+// Limits of error history to keep an error record under the item size limit
+// of DynamoDB (400KB).
+const (
+	maxHistoryEntries     = 20
+	maxHistoryMessageSize = 1024
+	maxProcessedIDs       = 50
+)
+
+// setLogLocation sets CloudWatch Logs group and stream of the failed request
+// to the record to find logs of the target Lambda.
+func setLogLocation(args argument, rec *functions.ErrorRecord, finder *logStreamFinder) {
+	functionArn := rec.FunctionArn
+	if functionArn == "" {
+		functionArn = args.targetArn
+	}
+	rec.LogGroup = logGroupName(functionArn)
+
+	if finder == nil || rec.LogGroup == "" || rec.RequestID == "" {
+		return
+	}
+
+	stream, err := finder.Find(args.ctx, rec.LogGroup, rec.RequestID, rec.OccurredAt)
+	if err != nil {
+		// Log stream is just a hint, then error is not critical.
+		logger.WithFields(logrus.Fields{
+			"error":     err,
+			"logGroup":  rec.LogGroup,
+			"requestID": rec.RequestID,
+		}).Warn("Fail to find log stream")
+		return
+	}
+
+	rec.LogStream = stream
+}
+
+// newHistoryEntry creates an entry of the failure. targetArn is the Lambda
+// that failed if the failure has no function ARN, e.g. a DLQ message.
+func newHistoryEntry(rec functions.ErrorRecord, targetArn string) functions.HistoryEntry {
+	entry := functions.HistoryEntry{
+		Timestamp:    rec.OccurredAt,
+		RequestID:    rec.RequestID,
+		ErrorMessage: rec.ErrorMessage,
+		Attempt:      rec.ErrorCount,
+		Qualifier:    rec.ExecutedVersion,
+		Target:       rec.FunctionArn,
+	}
+
+	if entry.Target == "" {
+		entry.Target = targetArn
+	}
+	if entry.Qualifier == "" {
+		entry.Qualifier = functionQualifier(entry.Target)
+	}
+	entry.ErrorMessage = functions.TruncateString(entry.ErrorMessage, maxHistoryMessageSize)
+
+	return entry
+}
+
+// addHistory returns history with entry, keeping the recent
+// maxHistoryEntries entries.
+func addHistory(history []functions.HistoryEntry, entry functions.HistoryEntry) []functions.HistoryEntry {
+	history = append(history, entry)
+	if len(history) > maxHistoryEntries {
+		history = history[len(history)-maxHistoryEntries:]
+	}
+	return history
 }
 
-type messageAttribute struct {
-	Type  string
-	Value string
+// maxTransitAttempts is a number of attempts to count up the existing record
+// that is modified concurrently.
+const maxTransitAttempts = 5
+
+// errDuplicated is returned when the failure was already counted.
+var errDuplicated = errors.New("Duplicated failure")
+
+// dedupID returns ID to detect duplicated delivery of the failure. Request ID
+// of the failed invocation is same even if the failure is delivered by both
+// DLQ and on-failure destination, and message ID is used for DLQ message
+// without request ID.
+func dedupID(msg dlqMessage, f *failure) string {
+	if f.RequestID != "" {
+		return f.RequestID
+	}
+	return msg.MessageID
 }
 
-func decodeViaJSON(src interface{}, dst interface{}) error {
-	rawData, err := json.Marshal(src)
+// addProcessedID returns processed IDs with id, keeping the recent
+// maxProcessedIDs IDs.
+func addProcessedID(ids []string, id string) []string {
+	ids = append(ids, id)
+	if len(ids) > maxProcessedIDs {
+		ids = ids[len(ids)-maxProcessedIDs:]
+	}
+	return ids
+}
+
+// countUp counts up error of existing record, adds the failure to history
+// and moves it to pending state in one update. It returns false if the record
+// was modified after it was read, and errDuplicated if the failure of id was
+// already counted.
+func countUp(ctx context.Context, table dynamo.Table, rec functions.ErrorRecord, id, targetArn string, newRecord *functions.ErrorRecord) (bool, error) {
+	var current functions.ErrorRecord
+	if err := table.Get("s3key", rec.S3Key).Consistent(true).OneWithContext(ctx, &current); err != nil {
+		return false, errors.Wrap(err, "Fail to get existing error record")
+	}
+
+	for _, processed := range current.ProcessedIDs {
+		if id != "" && processed == id {
+			return false, errDuplicated
+		}
+	}
+
+	update, err := functions.Transit(table, &current, functions.StatePending, "Failed again, request_id: "+rec.RequestID)
 	if err != nil {
-		return err
+		return false, err
+	}
+
+	if rec.RequestID != "" && current.RetryRequestID == rec.RequestID && current.RetryTarget != "" {
+		// The retry may be invoked to fallback target of the route.
+		targetArn = current.RetryTarget
+	}
+	rec.ErrorCount = current.ErrorCount + 1
+
+	// processed_ids and history are replaced safely because Transit checks
+	// version.
+	update = update.Set("history", addHistory(current.History, newHistoryEntry(rec, targetArn)))
+	if id != "" {
+		update = update.Set("processed_ids", addProcessedID(current.ProcessedIDs, id))
 	}
 
-	err = json.Unmarshal(rawData, dst)
+	err = update.
+		Add("error_count", 1).
+		Set("error_class", rec.ErrorClass).
+		ValueWithContext(ctx, newRecord)
+	if err != nil {
+		if functions.IsConditionalCheckFailed(err) {
+			return false, nil
+		}
+		return false, errors.Wrap(err, "Fail to update error count")
+	}
+
+	return true, nil
+}
+
+// putErrorRecord inserts a new error record or counts up error of existing
+// record. The failure is added to history of the record in both cases. It
+// returns the updated record if the failure is of a retry by Sweeper.
+// Duplicated delivery of the failure identified by id is skipped.
+func putErrorRecord(ctx context.Context, table dynamo.Table, rec functions.ErrorRecord, id, targetArn string) (*functions.ErrorRecord, error) {
+	rec.History = []functions.HistoryEntry{newHistoryEntry(rec, targetArn)}
+	rec.InitState("Failed, request_id: " + rec.RequestID)
+	if id != "" {
+		rec.ProcessedIDs = []string{id}
+	}
+
+	err := table.Put(rec).If("attribute_not_exists(s3key)").RunWithContext(ctx)
+	if err == nil {
+		// Succeeded to put a new record
+		logger.WithField("new", rec).Info("Inserted a new record")
+		return nil, nil
+	}
+
+	if !functions.IsConditionalCheckFailed(err) {
+		// Fail to put a new record other than existing record
+		logger.WithFields(logrus.Fields{
+			"error":  err,
+			"record": rec,
+		}).Error("Fail to put error data")
+		return nil, err
+	}
+
+	// Fail to put a new record because the record already exists
+	for i := 0; i < maxTransitAttempts; i++ {
+		var newRecord functions.ErrorRecord
+		updated, err := countUp(ctx, table, rec, id, targetArn, &newRecord)
+		if err == errDuplicated {
+			logger.WithFields(logrus.Fields{
+				"s3key": rec.S3Key,
+				"id":    id,
+			}).Info("Skip duplicated failure")
+			return nil, nil
+		}
+		if err != nil {
+			logger.WithFields(logrus.Fields{
+				"error":  err,
+				"record": rec,
+			}).Error("Fail to update error count")
+			return nil, err
+		}
+		if !updated {
+			continue
+		}
+
+		isRetry := rec.RequestID != "" && newRecord.RetryRequestID == rec.RequestID
+		logger.WithField("new", newRecord).Info("Updated the existing record")
+		if !isRetry {
+			return nil, nil
+		}
+		return &newRecord, nil
+	}
+
+	return nil, errors.Errorf("Fail to update error record modified concurrently: %s", rec.S3Key)
+}
+
+// resolve changes state of the record to resolved with time to recovery. A
+// group member that was retried by the leader has no retry_request_id of s.
+func resolve(ctx context.Context, table dynamo.Table, rec *functions.ErrorRecord, s *success) error {
+	update, err := functions.ResolveRetry(table, rec, s.RequestID, s.OccurredAt)
 	if err != nil {
 		return err
 	}
 
+	if rec.RetryRequestID == s.RequestID {
+		update = update.If("retry_request_id = ?", s.RequestID)
+	}
+
+	err = update.RunWithContext(ctx)
+	if err != nil {
+		return errors.Wrap(err, "Fail to resolve error record")
+	}
+
 	return nil
 }
 
-func handleEvent(record events.SNSEventRecord, table dynamo.Table) *errorInfo {
-	errInfo := &errorInfo{nil, events.S3Event{}}
+// breakers has CircuitBreaker per target Lambda of retry.
+type breakers struct {
+	args argument
+	pool map[string]*functions.CircuitBreaker
+}
 
-	errMsgEntity, ok := record.SNS.MessageAttributes["ErrorMessage"]
+// get returns circuit breaker of the target that handled the retry of the
+// record. Records retried without retry_target are of the target Lambda of
+// the stack.
+func (x *breakers) get(rec *functions.ErrorRecord) *functions.CircuitBreaker {
+	target := rec.RetryTarget
+	if target == "" {
+		target = x.args.targetArn
+	}
+
+	breaker, ok := x.pool[target]
 	if !ok {
-		logger.WithField("record", record).Warn("No ErrorMessage")
+		breaker = functions.NewCircuitBreaker(x.args.awsRegion, x.args.retryControlTable, target, x.args.circuitConfig)
+		x.pool[target] = breaker
+	}
+	return breaker
+}
+
+// keepSuccess saves the success to the record leased by Sweeper. The success
+// may be of the retry whose request ID is not saved yet, then the Sweeper
+// resolves the record on release of the lease.
+func keepSuccess(ctx context.Context, table dynamo.Table, rec *functions.ErrorRecord, s *success) error {
+	err := table.Update("s3key", rec.S3Key).
+		Set("success_request_id", s.RequestID).
+		Set("succeeded_at", s.OccurredAt).
+		If("retry_status = ?", functions.RetryStatusLeased).
+		RunWithContext(ctx)
+	if err != nil {
+		if functions.IsConditionalCheckFailed(err) {
+			// Released after the record was read. Redelivery of the message
+			// matches retry_request_id saved by the release.
+			return errors.Wrap(err, "Lease of error record was released")
+		}
+		return errors.Wrap(err, "Fail to keep success in error record")
+	}
+
+	return nil
+}
+
+// handleSuccess resolves error records of the objects in on-success record if
+// the invocation was a retry by Sweeper. Records are matched by request ID of
+// the invocation. Members of the group are also resolved by retry of the
+// group event. Success for a record leased by Sweeper is kept in the record
+// because it may arrive before the request ID is saved.
+func handleSuccess(args argument, msg dlqMessage, s *success, table dynamo.Table, breakers *breakers) *errorInfo {
+	errInfo := &errorInfo{MessageID: msg.MessageID}
+
+	var s3event events.S3Event
+	if err := json.Unmarshal(s.S3Event, &s3event); err != nil {
+		errInfo.Error = errors.Wrap(err, "Fail to parse json as S3 event")
 		return errInfo
 	}
+	errInfo.S3Event = s3event
+
+	var records []*functions.ErrorRecord
+	groups := map[string]bool{}
+	for _, s3record := range s3event.Records {
+		var rec functions.ErrorRecord
+		err := table.Get("s3key", functions.S3Key(s3record)).Consistent(true).OneWithContext(args.ctx, &rec)
+		if err == dynamo.ErrNotFound {
+			continue
+		} else if err != nil {
+			errInfo.Error = errors.Wrap(err, "Fail to get error record")
+			errInfo.retryable = true
+			return errInfo
+		}
+
+		records = append(records, &rec)
+		if rec.RetryRequestID == s.RequestID && rec.GroupID != "" {
+			groups[rec.GroupID] = true
+		}
+	}
+
+	var probes []*functions.ErrorRecord
+	resolved, kept := 0, 0
+	for _, rec := range records {
+		if rec.RetryRequestID != s.RequestID && !groups[rec.GroupID] {
+			if rec.RetryStatus != functions.RetryStatusLeased {
+				continue
+			}
+
+			if err := keepSuccess(args.ctx, table, rec, s); err != nil {
+				errInfo.Error = err
+				errInfo.retryable = true
+				return errInfo
+			}
+			logger.WithFields(logrus.Fields{
+				"s3key":     rec.S3Key,
+				"requestID": s.RequestID,
+			}).Info("Kept success for leased error record")
+			kept++
+			continue
+		}
+
+		if err := resolve(args.ctx, table, rec, s); err != nil {
+			if errors.Cause(err) == functions.ErrInvalidTransition {
+				// e.g. Already resolved by duplicated message.
+				logger.WithFields(logrus.Fields{
+					"error": err,
+					"s3key": rec.S3Key,
+				}).Warn("Skip resolving error record")
+				continue
+			}
+
+			errInfo.Error = err
+			errInfo.retryable = true
+			return errInfo
+		}
+
+		logger.WithFields(logrus.Fields{
+			"s3key":     rec.S3Key,
+			"requestID": s.RequestID,
+		}).Info("Resolved error record")
+		resolved++
+		if rec.RetryRequestID == s.RequestID {
+			// The retried record, not a group member, may be the probe.
+			probes = append(probes, rec)
+		}
+	}
+
+	if resolved == 0 {
+		if kept == 0 {
+			logger.WithField("requestID", s.RequestID).Info("Success is not retry by Sweeper")
+		}
+		return nil
+	}
+
+	for _, rec := range probes {
+		if err := breakers.get(rec).RecordRetrySuccess(args.ctx, rec.S3Key); err != nil {
+			// Circuit is closed by the next probe.
+			logger.WithFields(logrus.Fields{
+				"error":     err,
+				"requestID": s.RequestID,
+			}).Warn("Fail to record success of retry")
+		}
+	}
+
+	return nil
+}
+
+func handleEvent(args argument, msg dlqMessage, table dynamo.Table, finder *logStreamFinder,
+	classifier *functions.ErrorClassConfig, breakers *breakers) *errorInfo {
+	if s, ok := parseSuccess(msg); ok {
+		return handleSuccess(args, msg, s, table, breakers)
+	}
+
+	errInfo := &errorInfo{MessageID: msg.MessageID}
 
-	var errMsg messageAttribute
-	err := decodeViaJSON(errMsgEntity, &errMsg)
+	f, err := parseFailure(msg)
 	if err != nil {
-		logger.WithField("errMsgEntity", errMsgEntity).Warn("ErrorMessage can not be converted to MessageAttribute")
+		logger.WithFields(logrus.Fields{
+			"message": msg,
+			"error":   err,
+		}).Warn("Fail to parse failure message")
+		errInfo.Error = err
 		return errInfo
 	}
 
-	s3Msg := []byte(record.SNS.Message)
+	s3Msg := f.S3Event
 	var s3event events.S3Event
 	err = json.Unmarshal(s3Msg, &s3event)
 	if err != nil {
 		logger.WithFields(logrus.Fields{
-			"message": record.SNS.Message,
+			"message": string(s3Msg),
 			"error":   err,
 		}).Error("Fail to parse json as S3 event")
+		errInfo.Error = err
 		return errInfo
 	}
 
-	if len(s3event.Records) != 1 {
-		logger.WithField("event", s3event).Error("S3 record size is not 1")
+	errInfo.S3Event = s3event
+
+	if len(s3event.Records) == 0 {
+		logger.WithField("event", s3event).Error("No S3 record")
+		errInfo.Error = errors.New("No S3 record")
 		return errInfo
 	}
 
-	s3record := s3event.Records[0]
-	s3Key := s3record.S3.Bucket.Name + "/" + s3record.S3.Object.Key
-	rec := errorRecord{
-		S3Key:        s3Key,
-		OccurredAt:   record.SNS.Timestamp,
-		ErrorMessage: errMsg.Value,
+	base := functions.ErrorRecord{
+		OccurredAt:   f.OccurredAt,
+		RequestID:    f.RequestID,
+		ErrorCode:    f.ErrorCode,
+		ErrorMessage: f.ErrorMessage,
 		ErrorCount:   1,
-		S3Event:      s3Msg,
-		Retried:      false,
+
+		ErrorType:              f.ErrorType,
+		StackTrace:             f.StackTrace,
+		Condition:              f.Condition,
+		ApproximateInvokeCount: f.InvokeCount,
+		FunctionArn:            f.FunctionArn,
+		ExecutedVersion:        f.ExecutedVersion,
+
+		ErrorClass: classifier.Classify(f.ErrorType, f.ErrorCode, f.ErrorMessage),
+	}
+	setLogLocation(args, &base, finder)
+
+	// An event that has multiple S3 records is split into records per object
+	// that share group ID and the original event. Group ID is derived from the
+	// failure, then redelivery of the message after partial progress puts the
+	// rest of records into the same group.
+	var groupID string
+	if len(s3event.Records) > 1 {
+		groupID = uuid.NewSHA1(uuid.Nil, []byte(dedupID(msg, f))).String()
 	}
 
-	err = table.Put(rec).If("attribute_not_exists(s3key)").Run()
-	if err != nil {
-		if aerr, ok := err.(awserr.Error); ok {
-			if aerr.Code() == dynamodb.ErrCodeConditionalCheckFailedException {
-				// Fail to put a new record because the record already exists
-				var newRecord errorRecord
-				err = table.Update("s3key", s3Key).
-					Add("error_count", 1).
-					Set("retried", false).
-					Value(&newRecord)
-
-				if err != nil {
-					logger.WithFields(logrus.Fields{
-						"error":  err,
-						"record": rec,
-					}).Error("Fail to update error count")
-					return errInfo
-				}
-
-				logger.WithField("new", newRecord).Info("Updated the existing record")
-
-				return nil
+	// Members of the group share a retry by the leader, then the failure is
+	// counted once.
+	var retried *functions.ErrorRecord
+	for i, s3record := range s3event.Records {
+		rec := base
+		rec.S3Key = functions.S3Key(s3record)
+		rec.S3Event = s3Msg
+
+		if groupID != "" {
+			rec.S3Event, err = json.Marshal(events.S3Event{Records: []events.S3EventRecord{s3record}})
+			if err != nil {
+				errInfo.Error = errors.Wrap(err, "Fail to marshal S3 record")
+				return errInfo
 			}
+
+			rec.GroupID = groupID
+			rec.GroupIndex = i
+			rec.GroupSize = len(s3event.Records)
+			rec.GroupEvent = s3Msg
 		}
 
-		// Fail to put a new record other than existing record
-		logger.WithFields(logrus.Fields{
-			"error":  err,
-			"record": rec,
-		}).Error("Fail to put error data")
-		return errInfo
+		updated, err := putErrorRecord(args.ctx, table, rec, dedupID(msg, f), args.targetArn)
+		if err != nil {
+			errInfo.Error = err
+			errInfo.retryable = true
+			return errInfo
+		}
+		if updated != nil {
+			retried = updated
+		}
 	}
 
-	// Succeeded to put a new record
-	logger.WithField("new", rec).Info("Inserted a new record")
+	if retried != nil {
+		if err := breakers.get(retried).RecordRetryFailure(args.ctx, retried.S3Key, retried.RetriedAt); err != nil {
+			// Error records are already updated, then the message should not
+			// be handled again.
+			logger.WithFields(logrus.Fields{
+				"error":     err,
+				"requestID": f.RequestID,
+			}).Warn("Fail to record failure of retry")
+		}
+	}
 
 	return nil
 }
 
 func handler(args argument) (result, error) {
 	var res result
-	logger.WithField("event", args.event).Info("Start")
+	logger.WithField("messages", args.messages).Info("Start")
 
 	db := dynamo.New(session.New(), &aws.Config{Region: aws.String(args.awsRegion)})
 	table := db.Table(args.errorTable)
+	breakers := &breakers{args: args, pool: map[string]*functions.CircuitBreaker{}}
+
+	var finder *logStreamFinder
+	if args.lookupLogStream {
+		finder = newLogStreamFinder(args.awsRegion)
+	}
+
+	classifier, err := functions.ParseErrorClassConfig(args.errorClassConfig)
+	if err != nil {
+		return res, err
+	}
+
+	for i, msg := range args.messages {
+		if !functions.HasTimeLeft(args.ctx) {
+			for _, remain := range args.messages[i:] {
+				res.BatchItemFailures = append(res.BatchItemFailures, functions.BatchItemFailure{
+					ItemIdentifier: remain.MessageID,
+				})
+			}
+			logger.WithField("remaining", res.BatchItemFailures).
+				Warn("Deadline is approaching, some records are not processed")
+			break
+		}
 
-	for _, record := range args.event.Records {
-		errInfo := handleEvent(record, table)
+		errInfo := handleEvent(args, msg, table, finder, classifier, breakers)
 		if errInfo != nil {
 			res.Errors = append(res.Errors, errInfo)
+			if errInfo.retryable {
+				res.BatchItemFailures = append(res.BatchItemFailures, functions.BatchItemFailure{
+					ItemIdentifier: msg.MessageID,
+				})
+			}
+		} else {
+			res.Done++
 		}
 	}
 
+	if len(res.BatchItemFailures) > 0 && args.messages[0].Source != sourceSQS {
+		// Only SQS supports partial batch response. Then the whole event of
+		// SNS or EventBridge is retried by asynchronous invocation.
+		return res, errors.New("Some records are not processed")
+	}
+
 	return res, nil
 }
 
 func main() {
-	lambda.Start(func(ctx context.Context, event events.SNSEvent) (result, error) {
+	lambda.Start(func(ctx context.Context, event json.RawMessage) (result, error) {
 		logger = functions.SetLoggerContext(logger, ctx)
-		logger.WithField("event", event).Info("Start")
+		logger.WithField("event", string(event)).Info("Start")
+
+		messages, err := parseMessages(event)
+		if err != nil {
+			logger.WithField("error", err).Error("Fail to parse event")
+			return result{}, err
+		}
+
+		circuitConfig, err := functions.ParseCircuitConfig(
+			os.Getenv("CIRCUIT_FAILURE_RATE"),
+			os.Getenv("CIRCUIT_MIN_RETRIES"),
+			os.Getenv("CIRCUIT_WINDOW"),
+			os.Getenv("CIRCUIT_OPEN_DURATION"),
+			os.Getenv("CIRCUIT_PROBE_TIMEOUT"),
+			os.Getenv("RETRY_BUDGET_PER_HOUR"),
+		)
+		if err != nil {
+			logger.WithField("error", err).Error("Invalid circuit config")
+			return result{}, err
+		}
 
 		args := argument{
-			errorTable: os.Getenv("ERROR_TABLE"),
-			awsRegion:  os.Getenv("AWS_REGION"),
-			event:      event,
+			errorTable:        os.Getenv("ERROR_TABLE"),
+			retryControlTable: os.Getenv("RETRY_CONTROL_TABLE"),
+			awsRegion:         os.Getenv("AWS_REGION"),
+			targetArn:         os.Getenv("TARGET_LAMBDA_ARN"),
+			lookupLogStream:   os.Getenv("LOOKUP_LOG_STREAM") == "true",
+			errorClassConfig:  os.Getenv("ERROR_CLASS_CONFIG"),
+			circuitConfig:     circuitConfig,
+			messages:          messages,
+			ctx:               ctx,
 		}
 
 		return handler(args)
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"unicode/utf8"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/m-mizutani/chamber/functions"
+)
+
+func TestDedupID(t *testing.T) {
+	msg := dlqMessage{MessageID: "message-1"}
+
+	// Request ID is same for DLQ and on-failure destination.
+	assert.Equal(t, "request-1", dedupID(msg, &failure{RequestID: "request-1"}))
+	assert.Equal(t, "message-1", dedupID(msg, &failure{}))
+}
+
+func TestAddProcessedID(t *testing.T) {
+	ids := addProcessedID(nil, "id-0")
+	assert.Equal(t, []string{"id-0"}, ids)
+
+	for i := 1; i < maxProcessedIDs+5; i++ {
+		ids = addProcessedID(ids, fmt.Sprintf("id-%d", i))
+	}
+
+	// Only the recent IDs are kept.
+	assert.Equal(t, maxProcessedIDs, len(ids))
+	assert.Equal(t, "id-5", ids[0])
+	assert.Equal(t, fmt.Sprintf("id-%d", maxProcessedIDs+4), ids[len(ids)-1])
+}
+
+func TestNewHistoryEntry(t *testing.T) {
+	rec := functions.ErrorRecord{
+		RequestID:    "request-1",
+		ErrorMessage: "Blue",
+		ErrorCount:   2,
+	}
+
+	// DLQ message has no function ARN, then the target of the stack failed.
+	entry := newHistoryEntry(rec, "arn:aws:lambda:ap-northeast-1:1234567890:function:target:3")
+	assert.Equal(t, "request-1", entry.RequestID)
+	assert.Equal(t, "Blue", entry.ErrorMessage)
+	assert.Equal(t, 2, entry.Attempt)
+	assert.Equal(t, "arn:aws:lambda:ap-northeast-1:1234567890:function:target:3", entry.Target)
+	assert.Equal(t, "3", entry.Qualifier)
+
+	// Long message is cut at rune boundary.
+	rec.ErrorMessage = "a" + strings.Repeat("あ", maxHistoryMessageSize)
+	entry = newHistoryEntry(rec, "")
+	assert.True(t, len(entry.ErrorMessage) <= maxHistoryMessageSize)
+	assert.True(t, len(entry.ErrorMessage) > maxHistoryMessageSize-utf8.UTFMax)
+	assert.True(t, utf8.ValidString(entry.ErrorMessage))
+}
+
+func TestAddHistory(t *testing.T) {
+	var history []functions.HistoryEntry
+	for i := 1; i <= maxHistoryEntries+3; i++ {
+		history = addHistory(history, functions.HistoryEntry{Attempt: i})
+	}
+
+	// Only the recent entries are kept.
+	assert.Equal(t, maxHistoryEntries, len(history))
+	assert.Equal(t, 4, history[0].Attempt)
+	assert.Equal(t, maxHistoryEntries+3, history[len(history)-1].Attempt)
+}
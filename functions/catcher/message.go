@@ -0,0 +1,294 @@
+package main
+
+import (
+	"encoding/json"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// Event sources of DLQ message
+const (
+	sourceSNS         = "aws:sns"
+	sourceSQS         = "aws:sqs"
+	sourceEventBridge = "aws.events"
+)
+
+// detail-type of EventBridge event from Lambda Destinations.
+const (
+	detailTypeFailure = "Lambda Function Invocation Result - Failure"
+	detailTypeSuccess = "Lambda Function Invocation Result - Success"
+)
+
+// conditionSuccess is condition of invocation record of on-success.
+const conditionSuccess = "Success"
+
+// dlqMessage is a message from DLQ or on-failure destination of target
+// Lambda. SNS, SQS and EventBridge messages are converted to dlqMessage.
+type dlqMessage struct {
+	Source     string
+	MessageID  string
+	Body       string
+	Attributes map[string]string
+	Timestamp  time.Time
+}
+
+// Attribute names that Lambda attaches to DLQ message.
+var dlqAttributeNames = []string{"RequestID", "ErrorCode", "ErrorMessage"}
+
+type messageAttribute struct {
+	Type  string
+	Value string
+}
+
+func decodeViaJSON(src interface{}, dst interface{}) error {
+	rawData, err := json.Marshal(src)
+	if err != nil {
+		return err
+	}
+
+	err = json.Unmarshal(rawData, dst)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func newMessageFromSNS(record events.SNSEventRecord) dlqMessage {
+	msg := dlqMessage{
+		Source:     sourceSNS,
+		MessageID:  record.SNS.MessageID,
+		Body:       record.SNS.Message,
+		Attributes: map[string]string{},
+		Timestamp:  record.SNS.Timestamp,
+	}
+
+	for _, name := range dlqAttributeNames {
+		entity, ok := record.SNS.MessageAttributes[name]
+		if !ok {
+			continue
+		}
+
+		var attr messageAttribute
+		if err := decodeViaJSON(entity, &attr); err != nil {
+			logger.WithFields(logrus.Fields{
+				"name":   name,
+				"entity": entity,
+			}).Warn("Message attribute can not be converted to MessageAttribute")
+			continue
+		}
+
+		msg.Attributes[name] = attr.Value
+	}
+
+	return msg
+}
+
+// destinationRecord is an invocation record of Lambda Destinations.
+type destinationRecord struct {
+	Version        string `json:"version"`
+	Timestamp      string `json:"timestamp"`
+	RequestContext struct {
+		RequestID              string `json:"requestId"`
+		FunctionArn            string `json:"functionArn"`
+		Condition              string `json:"condition"`
+		ApproximateInvokeCount int    `json:"approximateInvokeCount"`
+	} `json:"requestContext"`
+	RequestPayload  json.RawMessage `json:"requestPayload"`
+	ResponseContext struct {
+		StatusCode      int    `json:"statusCode"`
+		ExecutedVersion string `json:"executedVersion"`
+		FunctionError   string `json:"functionError"`
+	} `json:"responseContext"`
+	ResponsePayload *struct {
+		ErrorMessage string   `json:"errorMessage"`
+		ErrorType    string   `json:"errorType"`
+		StackTrace   []string `json:"stackTrace"`
+	} `json:"responsePayload"`
+}
+
+// failure is information of failed invocation of target Lambda extracted
+// from dlqMessage.
+type failure struct {
+	S3Event         []byte
+	OccurredAt      time.Time
+	RequestID       string
+	ErrorCode       string
+	ErrorMessage    string
+	ErrorType       string
+	StackTrace      []string
+	Condition       string
+	InvokeCount     int
+	FunctionArn     string
+	ExecutedVersion string
+}
+
+// success is information of succeeded invocation of target Lambda extracted
+// from on-success record of Lambda Destinations.
+type success struct {
+	S3Event    []byte
+	OccurredAt time.Time
+	RequestID  string
+}
+
+// parseSuccess extracts success from message. ok is false if the message is
+// not an on-success record.
+func parseSuccess(msg dlqMessage) (s *success, ok bool) {
+	var record destinationRecord
+	if err := json.Unmarshal([]byte(msg.Body), &record); err != nil ||
+		record.RequestContext.Condition != conditionSuccess || len(record.RequestPayload) == 0 {
+		return nil, false
+	}
+
+	s = &success{
+		S3Event:    record.RequestPayload,
+		OccurredAt: msg.Timestamp,
+		RequestID:  record.RequestContext.RequestID,
+	}
+	if ts, err := time.Parse(time.RFC3339Nano, record.Timestamp); err == nil {
+		s.OccurredAt = ts
+	}
+
+	return s, true
+}
+
+// parseFailure extracts failure from message. Body of the message is an
+// original S3 event for DLQ or an invocation record for Lambda Destinations.
+func parseFailure(msg dlqMessage) (*failure, error) {
+	var record destinationRecord
+	if err := json.Unmarshal([]byte(msg.Body), &record); err == nil &&
+		record.RequestContext.RequestID != "" && len(record.RequestPayload) > 0 {
+		f := &failure{
+			S3Event:         record.RequestPayload,
+			OccurredAt:      msg.Timestamp,
+			RequestID:       record.RequestContext.RequestID,
+			Condition:       record.RequestContext.Condition,
+			InvokeCount:     record.RequestContext.ApproximateInvokeCount,
+			FunctionArn:     record.RequestContext.FunctionArn,
+			ExecutedVersion: record.ResponseContext.ExecutedVersion,
+			ErrorMessage:    record.RequestContext.Condition,
+		}
+
+		if ts, err := time.Parse(time.RFC3339Nano, record.Timestamp); err == nil {
+			f.OccurredAt = ts
+		}
+
+		// ResponsePayload is null if the function was not executed, e.g.
+		// condition is EventAgeExceeded.
+		if p := record.ResponsePayload; p != nil {
+			f.ErrorMessage = p.ErrorMessage
+			f.ErrorType = p.ErrorType
+			f.StackTrace = p.StackTrace
+		}
+
+		return f, nil
+	}
+
+	errMsg, ok := msg.Attributes["ErrorMessage"]
+	if !ok {
+		return nil, errors.New("No ErrorMessage")
+	}
+
+	// RequestID and ErrorCode are attached by Lambda as well as ErrorMessage.
+	return &failure{
+		S3Event:      []byte(msg.Body),
+		OccurredAt:   msg.Timestamp,
+		RequestID:    msg.Attributes["RequestID"],
+		ErrorCode:    msg.Attributes["ErrorCode"],
+		ErrorMessage: errMsg,
+	}, nil
+}
+
+func newMessageFromSQS(record events.SQSMessage) dlqMessage {
+	msg := dlqMessage{
+		Source:     sourceSQS,
+		MessageID:  record.MessageId,
+		Body:       record.Body,
+		Attributes: map[string]string{},
+		Timestamp:  time.Now().UTC(),
+	}
+
+	// SentTimestamp is epoch time in milliseconds
+	if ts, err := strconv.ParseInt(record.Attributes["SentTimestamp"], 10, 64); err == nil {
+		msg.Timestamp = time.Unix(ts/1000, (ts%1000)*int64(time.Millisecond)).UTC()
+	}
+
+	for _, name := range dlqAttributeNames {
+		if attr, ok := record.MessageAttributes[name]; ok && attr.StringValue != nil {
+			msg.Attributes[name] = *attr.StringValue
+		}
+	}
+
+	return msg
+}
+
+// parseMessages detects event source of Lambda event and converts records to
+// dlqMessage.
+func parseMessages(raw json.RawMessage) ([]dlqMessage, error) {
+	// Key of event source is "EventSource" in SNS and "eventSource" in SQS,
+	// and both match the field because json package ignores case.
+	var probe struct {
+		Records []struct {
+			EventSource string
+		}
+		ID         string          `json:"id"`
+		DetailType string          `json:"detail-type"`
+		Time       time.Time       `json:"time"`
+		Detail     json.RawMessage `json:"detail"`
+	}
+	if err := json.Unmarshal(raw, &probe); err != nil {
+		return nil, errors.Wrap(err, "Fail to parse event")
+	}
+
+	// EventBridge event has only one invocation record in detail.
+	if probe.DetailType != "" {
+		if probe.DetailType != detailTypeFailure && probe.DetailType != detailTypeSuccess {
+			return nil, errors.Errorf("Unsupported detail-type: '%s'", probe.DetailType)
+		}
+
+		return []dlqMessage{
+			{
+				Source:     sourceEventBridge,
+				MessageID:  probe.ID,
+				Body:       string(probe.Detail),
+				Attributes: map[string]string{},
+				Timestamp:  probe.Time,
+			},
+		}, nil
+	}
+
+	if len(probe.Records) == 0 {
+		return nil, nil
+	}
+
+	var messages []dlqMessage
+
+	switch source := probe.Records[0].EventSource; source {
+	case sourceSNS:
+		var event events.SNSEvent
+		if err := json.Unmarshal(raw, &event); err != nil {
+			return nil, errors.Wrap(err, "Fail to parse SNS event")
+		}
+		for _, record := range event.Records {
+			messages = append(messages, newMessageFromSNS(record))
+		}
+
+	case sourceSQS:
+		var event events.SQSEvent
+		if err := json.Unmarshal(raw, &event); err != nil {
+			return nil, errors.Wrap(err, "Fail to parse SQS event")
+		}
+		for _, record := range event.Records {
+			messages = append(messages, newMessageFromSQS(record))
+		}
+
+	default:
+		return nil, errors.Errorf("Unsupported event source: '%s'", source)
+	}
+
+	return messages, nil
+}
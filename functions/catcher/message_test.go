@@ -0,0 +1,189 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseMessagesSNS(t *testing.T) {
+	raw := `{"Records": [{
+		"EventSource": "aws:sns",
+		"Sns": {
+			"MessageId": "message-1",
+			"Message": "{\"Records\": []}",
+			"Timestamp": "2019-01-02T03:04:05.000Z",
+			"MessageAttributes": {
+				"RequestID": {"Type": "String", "Value": "request-1"},
+				"ErrorCode": {"Type": "Number", "Value": "200"},
+				"ErrorMessage": {"Type": "String", "Value": "Blue"}
+			}
+		}
+	}]}`
+
+	messages, err := parseMessages(json.RawMessage(raw))
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(messages))
+
+	msg := messages[0]
+	assert.Equal(t, sourceSNS, msg.Source)
+	assert.Equal(t, "message-1", msg.MessageID)
+	assert.Equal(t, `{"Records": []}`, msg.Body)
+	assert.Equal(t, time.Date(2019, 1, 2, 3, 4, 5, 0, time.UTC), msg.Timestamp.UTC())
+	assert.Equal(t, map[string]string{
+		"RequestID":    "request-1",
+		"ErrorCode":    "200",
+		"ErrorMessage": "Blue",
+	}, msg.Attributes)
+}
+
+func TestParseMessagesSQS(t *testing.T) {
+	raw := `{"Records": [{
+		"eventSource": "aws:sqs",
+		"messageId": "message-1",
+		"body": "{\"Records\": []}",
+		"attributes": {"SentTimestamp": "1546398245123"},
+		"messageAttributes": {
+			"RequestID": {"dataType": "String", "stringValue": "request-1"},
+			"ErrorMessage": {"dataType": "String", "stringValue": "Blue"}
+		}
+	}]}`
+
+	messages, err := parseMessages(json.RawMessage(raw))
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(messages))
+
+	msg := messages[0]
+	assert.Equal(t, sourceSQS, msg.Source)
+	assert.Equal(t, "message-1", msg.MessageID)
+	assert.Equal(t, time.Date(2019, 1, 2, 3, 4, 5, 123*int(time.Millisecond), time.UTC), msg.Timestamp)
+	assert.Equal(t, map[string]string{
+		"RequestID":    "request-1",
+		"ErrorMessage": "Blue",
+	}, msg.Attributes)
+}
+
+func TestParseMessagesUnsupported(t *testing.T) {
+	_, err := parseMessages(json.RawMessage(`{"Records": [{"eventSource": "aws:kinesis"}]}`))
+	assert.Error(t, err)
+
+	messages, err := parseMessages(json.RawMessage(`{"Records": []}`))
+	assert.NoError(t, err)
+	assert.Equal(t, 0, len(messages))
+}
+
+func TestParseFailureDLQ(t *testing.T) {
+	ts := time.Date(2019, 1, 2, 3, 4, 5, 0, time.UTC)
+	msg := dlqMessage{
+		Body: `{"Records": []}`,
+		Attributes: map[string]string{
+			"RequestID":    "request-1",
+			"ErrorCode":    "200",
+			"ErrorMessage": "Blue",
+		},
+		Timestamp: ts,
+	}
+
+	f, err := parseFailure(msg)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte(`{"Records": []}`), f.S3Event)
+	assert.Equal(t, ts, f.OccurredAt)
+	assert.Equal(t, "request-1", f.RequestID)
+	assert.Equal(t, "200", f.ErrorCode)
+	assert.Equal(t, "Blue", f.ErrorMessage)
+
+	// Message without ErrorMessage is not a DLQ message of Lambda.
+	delete(msg.Attributes, "ErrorMessage")
+	_, err = parseFailure(msg)
+	assert.Error(t, err)
+}
+
+const testFailureRecord = `{
+	"version": "1.0",
+	"timestamp": "2019-01-02T03:04:05.678Z",
+	"requestContext": {
+		"requestId": "request-1",
+		"functionArn": "arn:aws:lambda:ap-northeast-1:1234567890:function:target:$LATEST",
+		"condition": "RetriesExhausted",
+		"approximateInvokeCount": 3
+	},
+	"requestPayload": {"Records": []},
+	"responseContext": {"statusCode": 200, "executedVersion": "$LATEST", "functionError": "Unhandled"},
+	"responsePayload": {"errorMessage": "Blue", "errorType": "Error", "stackTrace": ["at a", "at b"]}
+}`
+
+func TestParseFailureDestination(t *testing.T) {
+	f, err := parseFailure(dlqMessage{Body: testFailureRecord, Attributes: map[string]string{}})
+	assert.NoError(t, err)
+	assert.Equal(t, `{"Records": []}`, string(f.S3Event))
+	assert.Equal(t, time.Date(2019, 1, 2, 3, 4, 5, 678*int(time.Millisecond), time.UTC), f.OccurredAt)
+	assert.Equal(t, "request-1", f.RequestID)
+	assert.Equal(t, "RetriesExhausted", f.Condition)
+	assert.Equal(t, 3, f.InvokeCount)
+	assert.Equal(t, "arn:aws:lambda:ap-northeast-1:1234567890:function:target:$LATEST", f.FunctionArn)
+	assert.Equal(t, "$LATEST", f.ExecutedVersion)
+	assert.Equal(t, "Blue", f.ErrorMessage)
+	assert.Equal(t, "Error", f.ErrorType)
+	assert.Equal(t, []string{"at a", "at b"}, f.StackTrace)
+}
+
+func TestParseFailureDestinationNotExecuted(t *testing.T) {
+	body := `{
+		"timestamp": "2019-01-02T03:04:05Z",
+		"requestContext": {"requestId": "request-1", "condition": "EventAgeExceeded", "approximateInvokeCount": 0},
+		"requestPayload": {"Records": []},
+		"responsePayload": null
+	}`
+
+	f, err := parseFailure(dlqMessage{Body: body, Attributes: map[string]string{}})
+	assert.NoError(t, err)
+	// Condition is the error message if the function was not executed.
+	assert.Equal(t, "EventAgeExceeded", f.ErrorMessage)
+	assert.Equal(t, "", f.ErrorType)
+}
+
+func TestParseMessagesEventBridge(t *testing.T) {
+	raw := `{
+		"id": "event-1",
+		"detail-type": "Lambda Function Invocation Result - Failure",
+		"time": "2019-01-02T03:04:05Z",
+		"detail": ` + testFailureRecord + `
+	}`
+
+	messages, err := parseMessages(json.RawMessage(raw))
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(messages))
+	assert.Equal(t, sourceEventBridge, messages[0].Source)
+	assert.Equal(t, "event-1", messages[0].MessageID)
+
+	f, err := parseFailure(messages[0])
+	assert.NoError(t, err)
+	assert.Equal(t, "request-1", f.RequestID)
+
+	_, err = parseMessages(json.RawMessage(`{"detail-type": "Scheduled Event", "detail": {}}`))
+	assert.Error(t, err)
+}
+
+func TestParseSuccess(t *testing.T) {
+	body := `{
+		"timestamp": "2019-01-02T03:04:05Z",
+		"requestContext": {"requestId": "request-2", "condition": "Success", "approximateInvokeCount": 1},
+		"requestPayload": {"Records": []},
+		"responseContext": {"statusCode": 200, "executedVersion": "$LATEST"},
+		"responsePayload": null
+	}`
+
+	s, ok := parseSuccess(dlqMessage{Body: body})
+	assert.True(t, ok)
+	assert.Equal(t, "request-2", s.RequestID)
+	assert.Equal(t, `{"Records": []}`, string(s.S3Event))
+	assert.Equal(t, time.Date(2019, 1, 2, 3, 4, 5, 0, time.UTC), s.OccurredAt)
+
+	// On-failure record and DLQ message are not success.
+	_, ok = parseSuccess(dlqMessage{Body: testFailureRecord})
+	assert.False(t, ok)
+	_, ok = parseSuccess(dlqMessage{Body: `{"Records": []}`})
+	assert.False(t, ok)
+}
@@ -0,0 +1,383 @@
+package functions
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/guregu/dynamo"
+	"github.com/pkg/errors"
+)
+
+// States of circuit breaker of retry.
+const (
+	// CircuitClosed allows retries.
+	CircuitClosed = "closed"
+	// CircuitOpen pauses retries until open_until.
+	CircuitOpen = "open"
+	// CircuitHalfOpen allows only one probe retry. The circuit is closed by
+	// success of the probe, or no failure of it in ProbeTimeout, and opened
+	// again by failure of it.
+	CircuitHalfOpen = "half_open"
+)
+
+// CircuitConfig is configuration of circuit breaker and retry budget.
+type CircuitConfig struct {
+	// FailureRate opens circuit if rate of failed retries in Window is
+	// FailureRate or more. 0 disables circuit breaker.
+	FailureRate float64
+	// MinRetries is minimum number of retries in Window to open circuit. It
+	// must be 1 or more.
+	MinRetries int
+	Window     time.Duration
+	// OpenDuration is time to pause retries before probe.
+	OpenDuration time.Duration
+	// ProbeTimeout is time to wait failure of probe. The circuit is closed if
+	// no failure arrives in it, then it must be longer than time to deliver
+	// failure of the target.
+	ProbeTimeout time.Duration
+	// BudgetPerHour is max number of retries per hour. 0 is unlimited.
+	BudgetPerHour int
+}
+
+// ParseCircuitConfig parses configuration given by environment variables.
+// Empty string is default value.
+func ParseCircuitConfig(failureRate, minRetries, window, openDuration, probeTimeout, budgetPerHour string) (*CircuitConfig, error) {
+	config := &CircuitConfig{
+		MinRetries:   10,
+		Window:       10 * time.Minute,
+		OpenDuration: 5 * time.Minute,
+		ProbeTimeout: 15 * time.Minute,
+	}
+
+	if failureRate != "" {
+		v, err := strconv.ParseFloat(failureRate, 64)
+		if err != nil || v < 0 || v > 1 {
+			return nil, errors.Errorf("Invalid CIRCUIT_FAILURE_RATE: '%s'", failureRate)
+		}
+		config.FailureRate = v
+	}
+
+	ints := []struct {
+		name  string
+		value string
+		dst   *int
+		min   uint64
+	}{
+		{"CIRCUIT_MIN_RETRIES", minRetries, &config.MinRetries, 1},
+		{"RETRY_BUDGET_PER_HOUR", budgetPerHour, &config.BudgetPerHour, 0},
+	}
+	for _, v := range ints {
+		if v.value == "" {
+			continue
+		}
+		n, err := strconv.ParseUint(v.value, 10, 32)
+		if err != nil || n < v.min {
+			return nil, errors.Errorf("Invalid %s: '%s'", v.name, v.value)
+		}
+		*v.dst = int(n)
+	}
+
+	durations := []struct {
+		name  string
+		value string
+		dst   *time.Duration
+	}{
+		{"CIRCUIT_WINDOW", window, &config.Window},
+		{"CIRCUIT_OPEN_DURATION", openDuration, &config.OpenDuration},
+		{"CIRCUIT_PROBE_TIMEOUT", probeTimeout, &config.ProbeTimeout},
+	}
+	for _, v := range durations {
+		if v.value == "" {
+			continue
+		}
+		n, err := strconv.ParseUint(v.value, 10, 32)
+		if err != nil || n == 0 {
+			return nil, errors.Errorf("Invalid %s: '%s'", v.name, v.value)
+		}
+		*v.dst = time.Duration(n) * time.Second
+	}
+
+	return config, nil
+}
+
+// shouldOpen returns true if failures of retries in a window exceed the
+// threshold.
+func (x *CircuitConfig) shouldOpen(retries, failures int) bool {
+	if retries == 0 || retries < x.MinRetries {
+		return false
+	}
+	return float64(failures)/float64(retries) >= x.FailureRate
+}
+
+// CircuitBreaker pauses retries of the target Lambda while most of retries
+// fail, e.g. the target is broken by a bad deploy. It also limits number of
+// retries per hour. Records of RetryControlTable are:
+//   - "circuit#{target}": state of circuit.
+//   - "stats#{target}#{window}": number of retries and failed retries in the
+//     window. A failure is counted in the window of the retry. It is expired
+//     by TTL.
+//   - "budget#{target}#{hour}": number of retries in the hour. It is expired
+//     by TTL.
+type CircuitBreaker struct {
+	table  dynamo.Table
+	target string
+	config *CircuitConfig
+}
+
+// CircuitRecord is a state of circuit.
+type CircuitRecord struct {
+	PK        string    `dynamo:"pk"`
+	State     string    `dynamo:"state"`
+	Reason    string    `dynamo:"reason"`
+	ChangedAt time.Time `dynamo:"changed_at"`
+	OpenUntil int64     `dynamo:"open_until"`
+	// ProbeS3Key is S3 key of the error record retried as the probe.
+	ProbeS3Key string `dynamo:"probe_s3key"`
+	ProbeUntil int64  `dynamo:"probe_until"`
+}
+
+type circuitCounter struct {
+	PK        string `dynamo:"pk"`
+	Retries   int    `dynamo:"retries"`
+	Failures  int    `dynamo:"failures"`
+	Count     int    `dynamo:"count"`
+	ExpiresAt int64  `dynamo:"expires_at"`
+}
+
+// NewCircuitBreaker is constructor of CircuitBreaker.
+func NewCircuitBreaker(region, tableName, target string, config *CircuitConfig) *CircuitBreaker {
+	db := dynamo.New(session.New(), &aws.Config{Region: aws.String(region)})
+	return &CircuitBreaker{
+		table:  db.Table(tableName),
+		target: target,
+		config: config,
+	}
+}
+
+func (x *CircuitBreaker) enabled() bool {
+	return x.config.FailureRate > 0
+}
+
+func (x *CircuitBreaker) circuitKey() string {
+	return "circuit#" + x.target
+}
+
+func (x *CircuitBreaker) statsKey(retriedAt time.Time) string {
+	return fmt.Sprintf("stats#%s#%d", x.target, retriedAt.Truncate(x.config.Window).Unix())
+}
+
+func (x *CircuitBreaker) budgetKey(now time.Time) string {
+	return fmt.Sprintf("budget#%s#%d", x.target, now.Truncate(time.Hour).Unix())
+}
+
+// State returns current state of circuit. Open circuit after OpenUntil is
+// half-open. Half-open circuit whose probe had no failure in ProbeTimeout is
+// closed, because success of the probe may not be delivered, e.g. the target
+// has no on-success destination.
+func (x *CircuitBreaker) State(ctx context.Context) (string, error) {
+	if !x.enabled() {
+		return CircuitClosed, nil
+	}
+
+	var circuit CircuitRecord
+	err := x.table.Get("pk", x.circuitKey()).Consistent(true).OneWithContext(ctx, &circuit)
+	if err == dynamo.ErrNotFound {
+		return CircuitClosed, nil
+	} else if err != nil {
+		return "", errors.Wrap(err, "Fail to get circuit")
+	}
+
+	now := time.Now().Unix()
+	if circuit.State == CircuitOpen && now >= circuit.OpenUntil {
+		return CircuitHalfOpen, nil
+	}
+	if circuit.State == CircuitHalfOpen && circuit.ProbeS3Key != "" && now >= circuit.ProbeUntil {
+		return x.closeTimedOutProbe(ctx, circuit.ProbeS3Key, now)
+	}
+	if circuit.State == "" {
+		return CircuitClosed, nil
+	}
+
+	return circuit.State, nil
+}
+
+// closeTimedOutProbe closes the circuit whose probe of s3key had no failure
+// until probe_until. It returns CircuitOpen to pause retries of the run if the
+// circuit was changed by others, and the next run reads the new state.
+func (x *CircuitBreaker) closeTimedOutProbe(ctx context.Context, s3key string, now int64) (string, error) {
+	err := x.table.Update("pk", x.circuitKey()).
+		Set("state", CircuitClosed).
+		Set("reason", "No failure of probe in probe timeout, s3key: "+s3key).
+		Set("changed_at", time.Now().UTC()).
+		If("'state' = ? AND probe_s3key = ? AND probe_until <= ?", CircuitHalfOpen, s3key, now).
+		RunWithContext(ctx)
+	if err != nil {
+		if IsConditionalCheckFailed(err) {
+			return CircuitOpen, nil
+		}
+		return "", errors.Wrap(err, "Fail to close circuit")
+	}
+
+	return CircuitClosed, nil
+}
+
+// AcquireProbe takes right to retry the record of s3key as a probe in
+// half-open state. It returns false if another Sweeper took it or the probe
+// is in flight.
+func (x *CircuitBreaker) AcquireProbe(ctx context.Context, s3key string) (bool, error) {
+	now := time.Now()
+	err := x.table.Update("pk", x.circuitKey()).
+		Set("state", CircuitHalfOpen).
+		Set("changed_at", now.UTC()).
+		Set("probe_s3key", s3key).
+		Set("probe_until", now.Add(x.config.ProbeTimeout).Unix()).
+		If("('state' = ? AND open_until <= ?) OR ('state' = ? AND probe_until <= ?)",
+			CircuitOpen, now.Unix(), CircuitHalfOpen, now.Unix()).
+		RunWithContext(ctx)
+	if err != nil {
+		if IsConditionalCheckFailed(err) {
+			return false, nil
+		}
+		return false, errors.Wrap(err, "Fail to acquire probe")
+	}
+
+	return true, nil
+}
+
+// ReleaseProbe gives up the probe of s3key that was not invoked, then another
+// probe can be taken immediately.
+func (x *CircuitBreaker) ReleaseProbe(ctx context.Context, s3key string) error {
+	err := x.table.Update("pk", x.circuitKey()).
+		Set("probe_until", time.Now().Unix()).
+		Remove("probe_s3key").
+		If("'state' = ? AND probe_s3key = ?", CircuitHalfOpen, s3key).
+		RunWithContext(ctx)
+	if err != nil && !IsConditionalCheckFailed(err) {
+		return errors.Wrap(err, "Fail to release probe")
+	}
+	return nil
+}
+
+func (x *CircuitBreaker) open(ctx context.Context, reason string) error {
+	now := time.Now()
+	circuit := CircuitRecord{
+		PK:        x.circuitKey(),
+		State:     CircuitOpen,
+		Reason:    reason,
+		ChangedAt: now.UTC(),
+		OpenUntil: now.Add(x.config.OpenDuration).Unix(),
+	}
+
+	if err := x.table.Put(circuit).RunWithContext(ctx); err != nil {
+		return errors.Wrap(err, "Fail to open circuit")
+	}
+	return nil
+}
+
+// TakeBudget counts a retry and returns false if retries in the hour exceed
+// BudgetPerHour.
+func (x *CircuitBreaker) TakeBudget(ctx context.Context, now time.Time) (bool, error) {
+	if x.config.BudgetPerHour == 0 {
+		return true, nil
+	}
+
+	var counter circuitCounter
+	err := x.table.Update("pk", x.budgetKey(now)).
+		Add("count", 1).
+		Set("expires_at", now.Truncate(time.Hour).Add(2*time.Hour).Unix()).
+		ValueWithContext(ctx, &counter)
+	if err != nil {
+		return false, errors.Wrap(err, "Fail to count retry budget")
+	}
+
+	return counter.Count <= x.config.BudgetPerHour, nil
+}
+
+// ReturnBudget gives back the budget taken at now by a retry that was not
+// invoked.
+func (x *CircuitBreaker) ReturnBudget(ctx context.Context, now time.Time) error {
+	if x.config.BudgetPerHour == 0 {
+		return nil
+	}
+
+	err := x.table.Update("pk", x.budgetKey(now)).
+		Add("count", -1).
+		If("attribute_exists(pk)").
+		RunWithContext(ctx)
+	if err != nil && !IsConditionalCheckFailed(err) {
+		return errors.Wrap(err, "Fail to return retry budget")
+	}
+	return nil
+}
+
+// RecordRetry counts a retry in the window of retriedAt.
+func (x *CircuitBreaker) RecordRetry(ctx context.Context, retriedAt time.Time) error {
+	if !x.enabled() {
+		return nil
+	}
+
+	err := x.table.Update("pk", x.statsKey(retriedAt)).
+		Add("retries", 1).
+		Set("expires_at", retriedAt.Add(x.config.Window*2).Unix()).
+		RunWithContext(ctx)
+	if err != nil {
+		return errors.Wrap(err, "Fail to count retry")
+	}
+	return nil
+}
+
+// RecordRetryFailure counts a failed retry of the record of s3key in the
+// window of retriedAt, when the retry was invoked. The circuit is opened if
+// the failure is of the probe, or rate of failed retries exceeds FailureRate.
+func (x *CircuitBreaker) RecordRetryFailure(ctx context.Context, s3key string, retriedAt time.Time) error {
+	if !x.enabled() {
+		return nil
+	}
+
+	var circuit CircuitRecord
+	err := x.table.Get("pk", x.circuitKey()).Consistent(true).OneWithContext(ctx, &circuit)
+	if err != nil && err != dynamo.ErrNotFound {
+		return errors.Wrap(err, "Fail to get circuit")
+	}
+	if circuit.State == CircuitHalfOpen && circuit.ProbeS3Key == s3key {
+		return x.open(ctx, "Probe failed, s3key: "+s3key)
+	}
+
+	var counter circuitCounter
+	err = x.table.Update("pk", x.statsKey(retriedAt)).
+		Add("failures", 1).
+		Set("expires_at", retriedAt.Add(x.config.Window*2).Unix()).
+		ValueWithContext(ctx, &counter)
+	if err != nil {
+		return errors.Wrap(err, "Fail to count failed retry")
+	}
+
+	if circuit.State == CircuitOpen || !x.config.shouldOpen(counter.Retries, counter.Failures) {
+		return nil
+	}
+
+	return x.open(ctx, fmt.Sprintf("%d of %d retries failed in %s", counter.Failures, counter.Retries, x.config.Window))
+}
+
+// RecordRetrySuccess closes the circuit if the success is of the probe, the
+// retry of the record of s3key.
+func (x *CircuitBreaker) RecordRetrySuccess(ctx context.Context, s3key string) error {
+	if !x.enabled() {
+		return nil
+	}
+
+	err := x.table.Update("pk", x.circuitKey()).
+		Set("state", CircuitClosed).
+		Set("reason", "Probe succeeded, s3key: "+s3key).
+		Set("changed_at", time.Now().UTC()).
+		If("'state' = ? AND probe_s3key = ?", CircuitHalfOpen, s3key).
+		RunWithContext(ctx)
+	if err != nil && !IsConditionalCheckFailed(err) {
+		return errors.Wrap(err, "Fail to close circuit")
+	}
+	return nil
+}
@@ -0,0 +1,73 @@
+package functions
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseCircuitConfigDefault(t *testing.T) {
+	config, err := ParseCircuitConfig("", "", "", "", "", "")
+	require.NoError(t, err)
+	assert.Equal(t, 0.0, config.FailureRate)
+	assert.Equal(t, 10, config.MinRetries)
+	assert.Equal(t, 10*time.Minute, config.Window)
+	assert.Equal(t, 5*time.Minute, config.OpenDuration)
+	assert.Equal(t, 15*time.Minute, config.ProbeTimeout)
+	assert.Equal(t, 0, config.BudgetPerHour)
+}
+
+func TestParseCircuitConfig(t *testing.T) {
+	config, err := ParseCircuitConfig("0.5", "3", "60", "120", "1800", "100")
+	require.NoError(t, err)
+	assert.Equal(t, 0.5, config.FailureRate)
+	assert.Equal(t, 3, config.MinRetries)
+	assert.Equal(t, time.Minute, config.Window)
+	assert.Equal(t, 2*time.Minute, config.OpenDuration)
+	assert.Equal(t, 30*time.Minute, config.ProbeTimeout)
+	assert.Equal(t, 100, config.BudgetPerHour)
+}
+
+func TestParseCircuitConfigInvalid(t *testing.T) {
+	invalid := [][]string{
+		{"1.5", "", "", "", "", ""},
+		{"-0.1", "", "", "", "", ""},
+		{"rate", "", "", "", "", ""},
+		{"", "0", "", "", "", ""},
+		{"", "-1", "", "", "", ""},
+		{"", "", "0", "", "", ""},
+		{"", "", "", "0", "", ""},
+		{"", "", "", "", "0", ""},
+		{"", "", "", "", "", "-1"},
+	}
+
+	for _, v := range invalid {
+		_, err := ParseCircuitConfig(v[0], v[1], v[2], v[3], v[4], v[5])
+		assert.Error(t, err, v)
+	}
+}
+
+func TestShouldOpen(t *testing.T) {
+	config := &CircuitConfig{FailureRate: 0.5, MinRetries: 4}
+
+	// Not enough retries in the window.
+	assert.False(t, config.shouldOpen(3, 3))
+	assert.False(t, config.shouldOpen(0, 2))
+
+	assert.False(t, config.shouldOpen(4, 1))
+	assert.True(t, config.shouldOpen(4, 2))
+	assert.True(t, config.shouldOpen(10, 10))
+}
+
+func TestStatsKey(t *testing.T) {
+	breaker := &CircuitBreaker{target: "arn:target", config: &CircuitConfig{Window: 10 * time.Minute}}
+	retriedAt := time.Date(2019, 1, 1, 10, 9, 59, 0, time.UTC)
+
+	// Window of the retry is decided by retriedAt, not by when the failure
+	// arrived.
+	assert.Equal(t, "stats#arn:target#1546336800", breaker.statsKey(retriedAt))
+	assert.Equal(t, breaker.statsKey(retriedAt), breaker.statsKey(retriedAt.Add(-9*time.Minute)))
+	assert.NotEqual(t, breaker.statsKey(retriedAt), breaker.statsKey(retriedAt.Add(time.Second)))
+}
@@ -0,0 +1,137 @@
+package functions
+
+import (
+	"encoding/json"
+	"regexp"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Typical error classes. Any class name can be used in ErrorClassConfig.
+const (
+	ErrorClassTransient = "transient"
+	ErrorClassPermanent = "permanent"
+	ErrorClassThrottled = "throttled"
+)
+
+// ErrorClassRule maps an error to a class. All specified conditions must
+// match. ErrorType and ErrorCode are compared exactly and Message is a
+// regular expression.
+type ErrorClassRule struct {
+	Class     string `json:"class"`
+	ErrorType string `json:"error_type"`
+	ErrorCode string `json:"error_code"`
+	Message   string `json:"message"`
+
+	message *regexp.Regexp
+}
+
+// ErrorClassPolicy is a retry policy of an error class.
+type ErrorClassPolicy struct {
+	MaxRetry int `json:"max_retry"`
+	// Delay is seconds to wait after the failure before retry.
+	Delay int `json:"delay"`
+}
+
+// ErrorClassConfig is configuration of error classification. It is given as
+// JSON, e.g.
+//
+//	{
+//	  "rules": [
+//	    {"class": "permanent", "error_type": "SchemaValidationError"},
+//	    {"class": "throttled", "message": "(?i)rate exceeded"}
+//	  ],
+//	  "default_class": "transient",
+//	  "policies": {
+//	    "transient": {"max_retry": 3},
+//	    "permanent": {"max_retry": 0},
+//	    "throttled": {"max_retry": 10, "delay": 30}
+//	  }
+//	}
+type ErrorClassConfig struct {
+	Rules        []*ErrorClassRule           `json:"rules"`
+	DefaultClass string                      `json:"default_class"`
+	Policies     map[string]ErrorClassPolicy `json:"policies"`
+}
+
+// ParseErrorClassConfig parses JSON configuration. Empty string returns
+// empty configuration that classifies all errors to ErrorClassTransient and
+// has no policy.
+func ParseErrorClassConfig(raw string) (*ErrorClassConfig, error) {
+	config := &ErrorClassConfig{}
+	if raw != "" {
+		if err := json.Unmarshal([]byte(raw), config); err != nil {
+			return nil, errors.Wrap(err, "Fail to parse error class config")
+		}
+	}
+
+	if config.DefaultClass == "" {
+		config.DefaultClass = ErrorClassTransient
+	}
+
+	for _, rule := range config.Rules {
+		if rule.Class == "" {
+			return nil, errors.New("Class of error class rule is required")
+		}
+
+		if rule.Message != "" {
+			ptn, err := regexp.Compile(rule.Message)
+			if err != nil {
+				return nil, errors.Wrapf(err, "Invalid message pattern: '%s'", rule.Message)
+			}
+			rule.message = ptn
+		}
+	}
+
+	return config, nil
+}
+
+func (x *ErrorClassRule) match(errType, errCode, message string) bool {
+	if x.ErrorType != "" && x.ErrorType != errType {
+		return false
+	}
+	if x.ErrorCode != "" && x.ErrorCode != errCode {
+		return false
+	}
+	if x.message != nil && !x.message.MatchString(message) {
+		return false
+	}
+
+	return true
+}
+
+// Classify returns class of the first matched rule or DefaultClass.
+func (x *ErrorClassConfig) Classify(errType, errCode, message string) string {
+	for _, rule := range x.Rules {
+		if rule.match(errType, errCode, message) {
+			return rule.Class
+		}
+	}
+
+	return x.DefaultClass
+}
+
+// Policy returns retry policy of the class. ok is false if the class has no
+// policy.
+func (x *ErrorClassConfig) Policy(class string) (policy ErrorClassPolicy, ok bool) {
+	policy, ok = x.Policies[class]
+	return
+}
+
+// MaxRetry returns the largest max_retry of policies and defaultMax, the max
+// retry of errors whose class has no policy.
+func (x *ErrorClassConfig) MaxRetry(defaultMax int) int {
+	max := defaultMax
+	for _, policy := range x.Policies {
+		if policy.MaxRetry > max {
+			max = policy.MaxRetry
+		}
+	}
+	return max
+}
+
+// DelayDuration returns Delay as time.Duration.
+func (x ErrorClassPolicy) DelayDuration() time.Duration {
+	return time.Duration(x.Delay) * time.Second
+}
@@ -0,0 +1,66 @@
+package functions
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestErrorClassConfigClassify(t *testing.T) {
+	config, err := ParseErrorClassConfig(`{
+		"rules": [
+			{"class": "permanent", "error_type": "SchemaValidationError"},
+			{"class": "throttled", "message": "(?i)rate exceeded"},
+			{"class": "permanent", "error_type": "AccessDenied", "error_code": "403"}
+		],
+		"policies": {"throttled": {"max_retry": 10, "delay": 30}}
+	}`)
+	assert.NoError(t, err)
+
+	assert.Equal(t, ErrorClassPermanent, config.Classify("SchemaValidationError", "", "bad field"))
+	assert.Equal(t, ErrorClassThrottled, config.Classify("ClientError", "", "Rate Exceeded"))
+	assert.Equal(t, ErrorClassPermanent, config.Classify("AccessDenied", "403", ""))
+	// All conditions of the rule must match.
+	assert.Equal(t, ErrorClassTransient, config.Classify("AccessDenied", "500", ""))
+	assert.Equal(t, ErrorClassTransient, config.Classify("TimeoutError", "", "timed out"))
+
+	policy, ok := config.Policy(ErrorClassThrottled)
+	assert.True(t, ok)
+	assert.Equal(t, 10, policy.MaxRetry)
+	assert.Equal(t, 30*time.Second, policy.DelayDuration())
+
+	_, ok = config.Policy(ErrorClassTransient)
+	assert.False(t, ok)
+}
+
+func TestParseErrorClassConfigDefaultClass(t *testing.T) {
+	config, err := ParseErrorClassConfig(`{"default_class": "permanent"}`)
+	assert.NoError(t, err)
+	assert.Equal(t, ErrorClassPermanent, config.Classify("Any", "", ""))
+}
+
+func TestParseErrorClassConfigInvalid(t *testing.T) {
+	_, err := ParseErrorClassConfig(`{"rules": [{"message": "x"}]}`)
+	assert.Error(t, err)
+
+	_, err = ParseErrorClassConfig(`{"rules": [{"class": "permanent", "message": "("}]}`)
+	assert.Error(t, err)
+
+	_, err = ParseErrorClassConfig(`{"rules": `)
+	assert.Error(t, err)
+}
+
+func TestErrorClassConfigMaxRetry(t *testing.T) {
+	config, err := ParseErrorClassConfig(`{"policies": {
+		"transient": {"max_retry": 3},
+		"throttled": {"max_retry": 10}
+	}}`)
+	assert.NoError(t, err)
+	assert.Equal(t, 10, config.MaxRetry(5))
+	assert.Equal(t, 12, config.MaxRetry(12))
+
+	empty, err := ParseErrorClassConfig("")
+	assert.NoError(t, err)
+	assert.Equal(t, 5, empty.MaxRetry(5))
+}
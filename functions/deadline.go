@@ -0,0 +1,34 @@
+package functions
+
+import (
+	"context"
+	"time"
+)
+
+// DeadlineMargin is a period reserved to return a result before Lambda
+// function is timed out. A handler should not start new work if remaining
+// time is less than the margin.
+const DeadlineMargin = 3 * time.Second
+
+// BatchItemFailure is an element of partial batch response. Lambda retries
+// only the reported items if ReportBatchItemFailures is enabled for the event
+// source.
+type BatchItemFailure struct {
+	ItemIdentifier string `json:"itemIdentifier"`
+}
+
+// HasTimeLeft returns false if the deadline of ctx will come within
+// DeadlineMargin or ctx is already done. It always returns true for ctx
+// without deadline.
+func HasTimeLeft(ctx context.Context) bool {
+	if ctx.Err() != nil {
+		return false
+	}
+
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		return true
+	}
+
+	return time.Until(deadline) > DeadlineMargin
+}
@@ -0,0 +1,307 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/sns"
+	"github.com/guregu/dynamo"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+
+	"github.com/m-mizutani/chamber/functions"
+)
+
+// loopGuard detects recursive invocation such as Dispatcher -> target -> S3
+// -> Kinesis -> Dispatcher, and halts dispatching for the offending prefix.
+//
+// Records of LoopGuardTable are:
+//   - "count#{family}#{window}": number of dispatches of the key family in
+//     the fixed window. It is expired by TTL.
+//   - "halt#{prefix}": dispatching for keys under prefix is halted. It must
+//     be deleted manually to resume.
+type loopGuard struct {
+	ctx         context.Context
+	table       dynamo.Table
+	snsSvc      *sns.SNS
+	alertTopic  string
+	window      time.Duration
+	threshold   int
+	repeatLimit int
+	halts       map[string]bool
+}
+
+type loopGuardCounter struct {
+	PK        string `dynamo:"pk"`
+	Count     int    `dynamo:"count"`
+	ExpiresAt int64  `dynamo:"expires_at"`
+}
+
+type loopGuardHalt struct {
+	PK       string    `dynamo:"pk"`
+	Prefix   string    `dynamo:"prefix"`
+	S3Key    string    `dynamo:"s3key"`
+	Reason   string    `dynamo:"reason"`
+	HaltedAt time.Time `dynamo:"halted_at"`
+	// Alerted is true after the alert of the halt was published.
+	Alerted bool `dynamo:"alerted"`
+}
+
+func newLoopGuard(args argument) (*loopGuard, error) {
+	window, err := strconv.ParseUint(args.loopWindow, 10, 64)
+	if err != nil || window == 0 {
+		return nil, errors.Errorf("Invalid LOOP_WINDOW: '%s'", args.loopWindow)
+	}
+	threshold, err := strconv.Atoi(args.loopThreshold)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Fail to parse LOOP_THRESHOLD: '%s'", args.loopThreshold)
+	}
+	repeatLimit, err := strconv.Atoi(args.loopRepeatLimit)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Fail to parse LOOP_REPEAT_LIMIT: '%s'", args.loopRepeatLimit)
+	}
+
+	ssn := session.Must(session.NewSession(&aws.Config{Region: aws.String(args.awsRegion)}))
+	db := dynamo.New(ssn)
+
+	return &loopGuard{
+		ctx:         args.ctx,
+		table:       db.Table(args.loopGuardTable),
+		snsSvc:      sns.New(ssn),
+		alertTopic:  args.alertTopicArn,
+		window:      time.Duration(window) * time.Second,
+		threshold:   threshold,
+		repeatLimit: repeatLimit,
+		halts:       map[string]bool{},
+	}, nil
+}
+
+// keyFamily returns directory prefix and family of the key. The family is the
+// directory and the file name without any extension, e.g. "bucket/dir/a" for
+// both of "bucket/dir/a.json" and "bucket/dir/a.json.gz".
+func keyFamily(bucket, key string) (string, string) {
+	dir, base := "", key
+	if pos := strings.LastIndex(key, "/"); pos >= 0 {
+		dir, base = key[:pos+1], key[pos+1:]
+	}
+
+	stem := base
+	if pos := strings.Index(base, "."); pos > 0 {
+		stem = base[:pos]
+	}
+
+	prefix := bucket + "/" + dir
+	return prefix, prefix + stem
+}
+
+// repeatedToken returns a token that appears at least limit times in suffixes
+// of the base name, e.g. "out" of "data.out.out.out" and "json" of
+// "a.json.processed.json.processed" with limit 2. A recursive loop grows the
+// base name by appending suffixes to the name of the parent object. Then
+// directories and the first token of the base name are not counted, because
+// they often repeat in legitimate keys such as "out/2024/out_report-out.csv".
+// Numeric tokens are ignored because they usually are dates or sequence
+// numbers.
+func repeatedToken(key string, limit int) string {
+	base := key[strings.LastIndex(key, "/")+1:]
+	tokens := strings.FieldsFunc(base, func(c rune) bool {
+		return c == '.' || c == '_' || c == '-'
+	})
+
+	counts := map[string]int{}
+	for i, token := range tokens {
+		if i == 0 || strings.IndexFunc(token, unicode.IsLetter) < 0 {
+			continue
+		}
+
+		counts[token]++
+		if counts[token] >= limit {
+			return token
+		}
+	}
+
+	return ""
+}
+
+// ancestors returns all directory prefixes of the key with bucket name.
+func ancestors(bucket, key string) []string {
+	prefixes := []string{bucket + "/"}
+	for i, c := range key {
+		if c == '/' {
+			prefixes = append(prefixes, bucket+"/"+key[:i+1])
+		}
+	}
+	return prefixes
+}
+
+func (x *loopGuard) isHalted(prefix string) (bool, error) {
+	if halted, ok := x.halts[prefix]; ok {
+		return halted, nil
+	}
+
+	var halt loopGuardHalt
+	err := x.table.Get("pk", "halt#"+prefix).OneWithContext(x.ctx, &halt)
+	if err != nil && err != dynamo.ErrNotFound {
+		return false, errors.Wrap(err, "Fail to get halt record")
+	}
+
+	if err == dynamo.ErrNotFound {
+		x.halts[prefix] = false
+		return false, nil
+	}
+
+	x.halts[prefix] = true
+	if !halt.Alerted {
+		// Publishing the alert failed when the prefix was halted.
+		x.alert(&halt)
+	}
+	return true, nil
+}
+
+// countDispatch increments counter of the key family and returns estimated
+// number of dispatches within the sliding window. The estimation is weighted
+// sum of current and previous fixed windows.
+func (x *loopGuard) countDispatch(family string) (int, error) {
+	now := time.Now()
+	current := now.Truncate(x.window)
+	previous := current.Add(-x.window)
+
+	var counter loopGuardCounter
+	err := x.table.Update("pk", fmt.Sprintf("count#%s#%d", family, current.Unix())).
+		Add("count", 1).
+		Set("expires_at", current.Add(x.window*3).Unix()).
+		ValueWithContext(x.ctx, &counter)
+	if err != nil {
+		return 0, errors.Wrap(err, "Fail to update dispatch counter")
+	}
+
+	var prev loopGuardCounter
+	err = x.table.Get("pk", fmt.Sprintf("count#%s#%d", family, previous.Unix())).
+		OneWithContext(x.ctx, &prev)
+	if err != nil && err != dynamo.ErrNotFound {
+		return 0, errors.Wrap(err, "Fail to get dispatch counter")
+	}
+
+	weight := 1 - float64(now.Sub(current))/float64(x.window)
+	return counter.Count + int(float64(prev.Count)*weight), nil
+}
+
+// halt saves halt record of the prefix and publishes alert. The halt record
+// is saved first to stop dispatching, and the alert is retried by isHalted of
+// later invocations until it is published.
+func (x *loopGuard) halt(prefix, s3key, reason string) error {
+	halt := loopGuardHalt{
+		PK:       "halt#" + prefix,
+		Prefix:   prefix,
+		S3Key:    s3key,
+		Reason:   reason,
+		HaltedAt: time.Now().UTC(),
+	}
+	x.halts[prefix] = true
+
+	logger.WithField("halt", halt).Error("Recursive loop is detected, halt dispatching")
+
+	err := x.table.Put(halt).If("attribute_not_exists(pk)").RunWithContext(x.ctx)
+	if err != nil {
+		if functions.IsConditionalCheckFailed(err) {
+			return nil // Already halted by other invocation
+		}
+		return errors.Wrap(err, "Fail to put halt record")
+	}
+
+	x.alert(&halt)
+	return nil
+}
+
+// alert publishes the halt to AlertTopic if it is set. A failure is only logged and not returned, because the halt record already
+// stops dispatching and a broken topic must not fail the whole batch.
+func (x *loopGuard) alert(halt *loopGuardHalt) {
+	if x.alertTopic == "" {
+		return
+	}
+
+	if err := x.publishAlert(halt); err != nil {
+		logger.WithFields(logrus.Fields{
+			"error":  err,
+			"prefix": halt.Prefix,
+		}).Error("Fail to alert halt, retry by later invocation")
+	}
+}
+
+// publishAlert publishes the halt and marks the halt record alerted.
+func (x *loopGuard) publishAlert(halt *loopGuardHalt) error {
+	msg, err := json.Marshal(halt)
+	if err != nil {
+		return errors.Wrap(err, "Fail to marshal alert message")
+	}
+
+	_, err = x.snsSvc.PublishWithContext(x.ctx, &sns.PublishInput{
+		TopicArn: aws.String(x.alertTopic),
+		Subject:  aws.String("Chamber halted dispatching: " + halt.Prefix),
+		Message:  aws.String(string(msg)),
+	})
+	if err != nil {
+		return errors.Wrap(err, "Fail to publish alert")
+	}
+
+	err = x.table.Update("pk", halt.PK).
+		Set("alerted", true).
+		If("attribute_exists(pk)").
+		RunWithContext(x.ctx)
+	if err != nil {
+		if functions.IsConditionalCheckFailed(err) {
+			return nil // Deleted to resume dispatching
+		}
+		return errors.Wrap(err, "Fail to mark halt record alerted")
+	}
+	halt.Alerted = true
+
+	return nil
+}
+
+// Allow returns false if the S3 record should not be dispatched because of
+// halted prefix or detected recursive loop.
+func (x *loopGuard) Allow(s3record events.S3EventRecord) (bool, error) {
+	bucket, key := s3record.S3.Bucket.Name, functions.DecodeObjectKey(s3record.S3.Object.Key)
+
+	for _, prefix := range ancestors(bucket, key) {
+		halted, err := x.isHalted(prefix)
+		if err != nil {
+			return false, err
+		}
+		if halted {
+			logger.WithFields(logrus.Fields{
+				"prefix": prefix,
+				"key":    key,
+			}).Warn("Dispatching is halted for prefix")
+			return false, nil
+		}
+	}
+
+	prefix, family := keyFamily(bucket, key)
+
+	if token := repeatedToken(key, x.repeatLimit); token != "" {
+		reason := fmt.Sprintf("Token '%s' repeats %d times or more in key", token, x.repeatLimit)
+		return false, x.halt(prefix, bucket+"/"+key, reason)
+	}
+
+	count, err := x.countDispatch(family)
+	if err != nil {
+		return false, err
+	}
+
+	if count > x.threshold {
+		reason := fmt.Sprintf("Key family '%s' is dispatched %d times in %s", family, count, x.window)
+		return false, x.halt(prefix, bucket+"/"+key, reason)
+	}
+
+	return true, nil
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestKeyFamily(t *testing.T) {
+	prefix, family := keyFamily("bucket", "dir/a.json")
+	assert.Equal(t, "bucket/dir/", prefix)
+	assert.Equal(t, "bucket/dir/a", family)
+
+	// Any extension belongs to the same family.
+	_, family = keyFamily("bucket", "dir/a.json.gz")
+	assert.Equal(t, "bucket/dir/a", family)
+
+	prefix, family = keyFamily("bucket", "a.json")
+	assert.Equal(t, "bucket/", prefix)
+	assert.Equal(t, "bucket/a", family)
+
+	// Leading dot is not an extension.
+	_, family = keyFamily("bucket", "dir/.hidden")
+	assert.Equal(t, "bucket/dir/.hidden", family)
+}
+
+func TestRepeatedToken(t *testing.T) {
+	assert.Equal(t, "out", repeatedToken("data.out.out.out", 3))
+	assert.Equal(t, "", repeatedToken("data.out.out", 3))
+	assert.Equal(t, "out", repeatedToken("dir/data_out_out.out", 3))
+
+	// Not consecutive occurrences are counted.
+	assert.Equal(t, "json", repeatedToken("a.json.processed.json.processed", 2))
+	assert.Equal(t, "processed", repeatedToken("a.processed.json.processed", 2))
+
+	// Numeric tokens are ignored.
+	assert.Equal(t, "", repeatedToken("logs/2019/01/01/01.log", 2))
+}
+
+func TestRepeatedTokenLegitimateKey(t *testing.T) {
+	// Directories and the first token of the base name are not counted.
+	assert.Equal(t, "", repeatedToken("out/2024/out_report-out.csv", 2))
+	assert.Equal(t, "", repeatedToken("out/out/out/report.csv", 3))
+	assert.Equal(t, "", repeatedToken("data/data/data_data.csv", 2))
+	assert.Equal(t, "", repeatedToken("logs/log/log-2019-01-01.log", 2))
+	assert.Equal(t, "", repeatedToken("archive/report.tar.gz", 2))
+}
+
+func TestAncestors(t *testing.T) {
+	assert.Equal(t, []string{"bucket/", "bucket/a/", "bucket/a/b/"}, ancestors("bucket", "a/b/c.json"))
+	assert.Equal(t, []string{"bucket/"}, ancestors("bucket", "c.json"))
+}
@@ -17,20 +17,34 @@ import (
 var logger = functions.NewLogger()
 
 type result struct {
-	Result string `json:"result"`
-	Done   int    `json:"done"`
+	Result            string                       `json:"result"`
+	Done              int                          `json:"done"`
+	BatchItemFailures []functions.BatchItemFailure `json:"batchItemFailures"`
 }
 
 type argument struct {
-	lambdaArn       string
-	awsRegion       string
-	whitePrefixList []string
-	event           events.KinesisEvent
-	ctx             context.Context
+	lambdaArn                string
+	awsRegion                string
+	whitePrefixList          []string
+	serializeByKey           bool
+	keyStateTable            string
+	loopGuardTable           string
+	loopWindow               string
+	loopThreshold            string
+	loopRepeatLimit          string
+	alertTopicArn            string
+	allowedSourceBuckets     string
+	allowedOwnerPrincipalIDs string
+	allowedRegions           string
+	verifyObjectExists       bool
+	quarantineTable          string
+	quarantineBucket         string
+	event                    events.KinesisEvent
+	ctx                      context.Context
 }
 
 func matchWhiteList(s3record events.S3EventRecord, whitelist []string) bool {
-	path := s3record.S3.Bucket.Name + "/" + s3record.S3.Object.Key
+	path := functions.S3Key(s3record)
 
 	for _, wprefix := range whitelist {
 		if strings.HasPrefix(path, wprefix) {
@@ -46,59 +60,288 @@ func matchWhiteList(s3record events.S3EventRecord, whitelist []string) bool {
 	return false
 }
 
-func handler(args argument) (result, error) {
-	var res result
+// dispatcher has optional components to dispatch S3 records.
+type dispatcher struct {
+	args       argument
+	invoker    functions.LambdaInvoker
+	serializer *keySerializer
+	guard      *loopGuard
+	verifier   *sourceVerifier
+	quarantine *functions.Quarantine
+}
 
-	logger.WithField("args", args).Info("Start function")
+func newDispatcher(args argument) (*dispatcher, error) {
+	x := &dispatcher{
+		args:    args,
+		invoker: functions.NewLambdaInvoker(args.awsRegion, args.lambdaArn),
+	}
 
-	invoker := functions.NewLambdaInvoker(args.awsRegion, args.lambdaArn)
+	if args.serializeByKey {
+		x.serializer = newKeySerializer(args, x.invoker)
+	}
 
-	for _, record := range args.event.Records {
-		var s3event events.S3Event
-		err := json.Unmarshal(record.Kinesis.Data, &s3event)
+	if args.loopGuardTable != "" {
+		guard, err := newLoopGuard(args)
 		if err != nil {
-			logger.WithFields(logrus.Fields{
-				"error": err,
-				"data":  string(record.Kinesis.Data),
-			}).Warn("Fail to unmarshal s3 event")
+			return nil, err
+		}
+		x.guard = guard
+	}
+
+	if verifier := newSourceVerifier(args); verifier.enabled() {
+		x.verifier = verifier
+	}
+
+	if args.quarantineTable != "" {
+		x.quarantine = functions.NewQuarantine(args.awsRegion, args.quarantineTable, args.quarantineBucket)
+	}
+
+	return x, nil
+}
+
+// verify returns false if the S3 record fails source verification. The
+// record is saved to QuarantineTable with the reason.
+func (x *dispatcher) verify(record events.KinesisEventRecord, s3record events.S3EventRecord) (bool, error) {
+	if x.verifier == nil {
+		return true, nil
+	}
+
+	reason, err := x.verifier.Verify(s3record)
+	if err != nil {
+		return false, errors.Wrap(err, "Fail to verify source")
+	}
+	if reason == "" {
+		return true, nil
+	}
+
+	logger.WithFields(logrus.Fields{
+		"reason":   reason,
+		"s3record": s3record,
+	}).Warn("S3 record failed source verification")
+
+	data, err := json.Marshal(events.S3Event{Records: []events.S3EventRecord{s3record}})
+	if err != nil {
+		return false, errors.Wrap(err, "Fail to marshal S3 record")
+	}
+
+	rec := functions.NewQuarantineRecord(functions.QuarantineUnverified, reason, record)
+	rec.S3Key = functions.S3Key(s3record)
+	rec.Data = data
+
+	return false, x.putQuarantine(rec)
+}
+
+// quarantineFailure saves the S3 record that target Lambda failed to process
+// in serialized dispatch.
+func (x *dispatcher) quarantineFailure(record events.KinesisEventRecord, s3record events.S3EventRecord, cause error) error {
+	logger.WithFields(logrus.Fields{
+		"error":    cause,
+		"s3record": s3record,
+	}).Warn("Target Lambda failed in serialized dispatch")
+
+	data, err := json.Marshal(events.S3Event{Records: []events.S3EventRecord{s3record}})
+	if err != nil {
+		return errors.Wrap(err, "Fail to marshal S3 record")
+	}
+
+	rec := functions.NewQuarantineRecord(functions.QuarantineFailed, cause.Error(), record)
+	rec.S3Key = functions.S3Key(s3record)
+	rec.Data = data
+
+	return x.putQuarantine(rec)
+}
+
+// errNoQuarantine is returned when a record must be quarantined but
+// QuarantineTable is not set. The record is retried instead of dropped.
+var errNoQuarantine = errors.New("QuarantineTable is not set, record can not be quarantined")
+
+func (x *dispatcher) putQuarantine(rec *functions.QuarantineRecord) error {
+	if x.quarantine == nil {
+		logger.WithFields(logrus.Fields{
+			"kind":     rec.Kind,
+			"reason":   rec.Reason,
+			"sequence": rec.SequenceNumber,
+		}).Error("No QuarantineTable to keep record")
+		return errNoQuarantine
+	}
+
+	if err := x.quarantine.Put(x.args.ctx, rec); err != nil {
+		return err
+	}
+
+	logger.WithFields(logrus.Fields{
+		"id":     rec.ID,
+		"kind":   rec.Kind,
+		"reason": rec.Reason,
+	}).Info("Quarantined record")
+
+	return nil
+}
+
+// dispatchRecord invokes target Lambda for each S3 record in a Kinesis
+// record and returns number of invocations. Progress in the Kinesis record is
+// not saved, so S3 records before an error are dispatched again when the
+// Kinesis record is retried. Target Lambda must be idempotent for them.
+func (x *dispatcher) dispatchRecord(record events.KinesisEventRecord) (int, error) {
+	var done int
+	args := x.args
+
+	var s3event events.S3Event
+	err := json.Unmarshal(record.Kinesis.Data, &s3event)
+	if err != nil {
+		logger.WithFields(logrus.Fields{
+			"error": err,
+			"data":  string(record.Kinesis.Data),
+		}).Warn("Fail to unmarshal s3 event")
+
+		rec := functions.NewQuarantineRecord(functions.QuarantineMalformed, err.Error(), record)
+		return done, x.putQuarantine(rec)
+	}
+
+	for _, s3record := range s3event.Records {
+		logger.WithField("s3record", s3record).Info("S3 record")
+
+		if args.whitePrefixList[0] != "" && !matchWhiteList(s3record, args.whitePrefixList) {
 			continue
 		}
 
-		for _, s3record := range s3event.Records {
-			logger.WithField("s3record", s3record).Info("S3 record")
+		verified, err := x.verify(record, s3record)
+		if err != nil {
+			return done, err
+		}
+		if !verified {
+			continue
+		}
 
-			if args.whitePrefixList[0] != "" && !matchWhiteList(s3record, args.whitePrefixList) {
+		if x.guard != nil {
+			allowed, err := x.guard.Allow(s3record)
+			if err != nil {
+				return done, errors.Wrap(err, "Fail to check recursive loop")
+			}
+			if !allowed {
 				continue
 			}
+		}
 
-			err := invoker.Invoke(s3record)
+		if x.serializer != nil {
+			invoked, err := x.serializer.Dispatch(s3record)
+			if ferr, ok := err.(*functions.FunctionError); ok {
+				// Synchronous invocation does not reach DLQ of target Lambda.
+				// Keep the event for resubmission instead of blocking the
+				// shard.
+				if err := x.quarantineFailure(record, s3record, ferr); err != nil {
+					return done, err
+				}
+				continue
+			}
 			if err != nil {
 				logger.WithFields(logrus.Fields{
 					"error":    err,
 					"s3record": s3record,
-				}).Error("Invoke Error")
+				}).Error("Serialized dispatch Error")
+
+				return done, errors.Wrap(err, "Fail to dispatch event in order")
+			}
+
+			if invoked {
+				done++
+			}
+			continue
+		}
+
+		err = x.invoker.Invoke(args.ctx, s3record)
+		if err != nil {
+			logger.WithFields(logrus.Fields{
+				"error":    err,
+				"s3record": s3record,
+			}).Error("Invoke Error")
 
-				return res, errors.Wrap(err, "Fail to invoke Lambda")
+			return done, errors.Wrap(err, "Fail to invoke Lambda")
+		}
+
+		done++
+	}
+
+	return done, nil
+}
+
+func handler(args argument) (result, error) {
+	var res result
+
+	logger.WithField("args", args).Info("Start function")
+
+	dispatcher, err := newDispatcher(args)
+	if err != nil {
+		return res, err
+	}
+
+	for i, record := range args.event.Records {
+		if !functions.HasTimeLeft(args.ctx) {
+			res.BatchItemFailures = remainingRecords(args.event.Records[i:])
+			logger.WithField("remaining", len(res.BatchItemFailures)).
+				Warn("Stop dispatching because deadline is approaching")
+			break
+		}
+
+		done, err := dispatcher.dispatchRecord(record)
+		res.Done += done
+
+		if err != nil {
+			if args.ctx.Err() != nil {
+				// Invocation was cancelled by deadline, then retry from the record.
+				res.BatchItemFailures = remainingRecords(args.event.Records[i:])
+				break
+			}
+			if errors.Cause(err) == errKeyLocked || errors.Cause(err) == errNoQuarantine {
+				// Retry from the record to keep order of events in the shard.
+				res.BatchItemFailures = remainingRecords(args.event.Records[i:])
+				logger.WithField("remaining", len(res.BatchItemFailures)).
+					WithField("error", err).
+					Warn("Stop dispatching and retry from the record")
+				break
 			}
 
-			res.Done++
+			return res, err
 		}
 	}
 
 	return res, nil
 }
 
+func remainingRecords(records []events.KinesisEventRecord) []functions.BatchItemFailure {
+	var failures []functions.BatchItemFailure
+	for _, record := range records {
+		failures = append(failures, functions.BatchItemFailure{
+			ItemIdentifier: record.Kinesis.SequenceNumber,
+		})
+	}
+	return failures
+}
+
 func main() {
 	lambda.Start(func(ctx context.Context, event events.KinesisEvent) (result, error) {
 		logger = functions.SetLoggerContext(logger, ctx)
 		logger.WithField("event", event).Info("Start")
 
 		args := argument{
-			lambdaArn:       os.Getenv("TARGET_LAMBDA_ARN"),
-			awsRegion:       os.Getenv("AWS_REGION"),
-			whitePrefixList: strings.Split(os.Getenv("WHITE_PREFIX_LIST"), ","),
-			event:           event,
-			ctx:             ctx,
+			lambdaArn:                os.Getenv("TARGET_LAMBDA_ARN"),
+			awsRegion:                os.Getenv("AWS_REGION"),
+			whitePrefixList:          strings.Split(os.Getenv("WHITE_PREFIX_LIST"), ","),
+			serializeByKey:           os.Getenv("SERIALIZE_BY_KEY") == "true",
+			keyStateTable:            os.Getenv("KEY_STATE_TABLE"),
+			loopGuardTable:           os.Getenv("LOOP_GUARD_TABLE"),
+			loopWindow:               os.Getenv("LOOP_WINDOW"),
+			loopThreshold:            os.Getenv("LOOP_THRESHOLD"),
+			loopRepeatLimit:          os.Getenv("LOOP_REPEAT_LIMIT"),
+			alertTopicArn:            os.Getenv("ALERT_TOPIC_ARN"),
+			allowedSourceBuckets:     os.Getenv("ALLOWED_SOURCE_BUCKETS"),
+			allowedOwnerPrincipalIDs: os.Getenv("ALLOWED_OWNER_PRINCIPAL_IDS"),
+			allowedRegions:           os.Getenv("ALLOWED_REGIONS"),
+			verifyObjectExists:       os.Getenv("VERIFY_OBJECT_EXISTS") == "true",
+			quarantineTable:          os.Getenv("QUARANTINE_TABLE"),
+			quarantineBucket:         os.Getenv("QUARANTINE_BUCKET"),
+			event:                    event,
+			ctx:                      ctx,
 		}
 
 		return handler(args)
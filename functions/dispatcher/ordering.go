@@ -0,0 +1,163 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-lambda-go/lambdacontext"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/guregu/dynamo"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+
+	"github.com/m-mizutani/chamber/functions"
+)
+
+// defaultKeyLockDuration is used as lock period when deadline of Lambda
+// function is not available.
+const defaultKeyLockDuration = time.Minute
+
+// keyState is a record of KeyStateTable. It has last processed sequencer and
+// lock of the object key.
+type keyState struct {
+	S3Key       string    `dynamo:"s3key"`
+	Sequencer   string    `dynamo:"sequencer"`
+	LockOwner   string    `dynamo:"lock_owner"`
+	LockedUntil int64     `dynamo:"locked_until"`
+	UpdatedAt   time.Time `dynamo:"updated_at"`
+}
+
+// keySerializer dispatches S3 events one by one per object key. It never
+// invokes target Lambda for a key while another invocation for the same key
+// is in flight, and drops events older than last processed one.
+type keySerializer struct {
+	ctx     context.Context
+	table   dynamo.Table
+	invoker functions.LambdaInvoker
+	owner   string
+	until   time.Time
+}
+
+func newKeySerializer(args argument, invoker functions.LambdaInvoker) *keySerializer {
+	db := dynamo.New(session.New(), &aws.Config{Region: aws.String(args.awsRegion)})
+
+	x := &keySerializer{
+		ctx:     args.ctx,
+		table:   db.Table(args.keyStateTable),
+		invoker: invoker,
+		owner:   "N/A",
+		until:   time.Now().Add(defaultKeyLockDuration),
+	}
+
+	if lc, ok := lambdacontext.FromContext(args.ctx); ok {
+		x.owner = lc.AwsRequestID
+	}
+	// Lock is released automatically after the Dispatcher is timed out.
+	if deadline, ok := args.ctx.Deadline(); ok {
+		x.until = deadline.Add(time.Second)
+	}
+
+	return x
+}
+
+// errKeyLocked is returned when another invocation is in flight for the key.
+var errKeyLocked = errors.New("Object key is locked by other invocation")
+
+// Lock of the key is retried keyLockAttempts times in keyLockInterval before
+// giving up the Kinesis record. The lock expires at deadline of the holder,
+// then retry of the Kinesis record takes it.
+const (
+	keyLockAttempts = 5
+	keyLockInterval = time.Second
+)
+
+func (x *keySerializer) lock(s3key string) (*keyState, error) {
+	var state keyState
+	now := time.Now()
+
+	err := x.table.Update("s3key", s3key).
+		Set("lock_owner", x.owner).
+		Set("locked_until", x.until.Unix()).
+		If("attribute_not_exists(locked_until) OR locked_until < ?", now.Unix()).
+		ValueWithContext(x.ctx, &state)
+	if err != nil {
+		if functions.IsConditionalCheckFailed(err) {
+			return nil, errKeyLocked
+		}
+		return nil, errors.Wrap(err, "Fail to lock object key")
+	}
+
+	return &state, nil
+}
+
+func (x *keySerializer) unlock(s3key, sequencer string) error {
+	query := x.table.Update("s3key", s3key).
+		Remove("lock_owner", "locked_until").
+		Set("updated_at", time.Now().UTC()).
+		If("lock_owner = ?", x.owner)
+	if sequencer != "" {
+		query = query.Set("sequencer", sequencer)
+	}
+
+	if err := query.RunWithContext(x.ctx); err != nil {
+		return errors.Wrap(err, "Fail to unlock object key")
+	}
+
+	return nil
+}
+
+// waitLock takes lock of the key, waiting for release by other invocation.
+func (x *keySerializer) waitLock(s3key string) (*keyState, error) {
+	for i := 1; ; i++ {
+		state, err := x.lock(s3key)
+		if err != errKeyLocked || i >= keyLockAttempts || !functions.HasTimeLeft(x.ctx) {
+			return state, err
+		}
+
+		select {
+		case <-time.After(keyLockInterval):
+		case <-x.ctx.Done():
+			return nil, x.ctx.Err()
+		}
+	}
+}
+
+// Dispatch invokes target Lambda synchronously while holding lock of the key.
+// It returns (false, nil) if the event is dropped as stale, errKeyLocked if
+// the lock is not available, and *functions.FunctionError if target Lambda
+// failed.
+func (x *keySerializer) Dispatch(s3record events.S3EventRecord) (bool, error) {
+	s3key := functions.S3Key(s3record)
+	sequencer := s3record.S3.Object.Sequencer
+
+	state, err := x.waitLock(s3key)
+	if err != nil {
+		return false, err
+	}
+
+	if sequencer != "" && state.Sequencer != "" &&
+		functions.CompareSequencer(sequencer, state.Sequencer) <= 0 {
+		logger.WithFields(logrus.Fields{
+			"s3key":     s3key,
+			"sequencer": sequencer,
+			"last":      state.Sequencer,
+		}).Info("Drop stale event")
+
+		return false, x.unlock(s3key, "")
+	}
+
+	if err := x.invoker.InvokeSync(x.ctx, s3record); err != nil {
+		// Keep last sequencer to allow retry of the event.
+		if uerr := x.unlock(s3key, ""); uerr != nil {
+			logger.WithFields(logrus.Fields{
+				"error": uerr,
+				"s3key": s3key,
+			}).Error("Fail to unlock after invoke error")
+		}
+		return false, err
+	}
+
+	return true, x.unlock(s3key, sequencer)
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/pkg/errors"
+
+	"github.com/m-mizutani/chamber/functions"
+)
+
+// sourceVerifier checks S3 records in Kinesis stream against allowed sources.
+// The checked fields are written by the producer of the record, so it guards
+// against misconfigured event sources, not forged records.
+type sourceVerifier struct {
+	ctx               context.Context
+	buckets           []string
+	ownerPrincipalIDs []string
+	regions           []string
+	verifyExists      bool
+	s3svc             *s3.S3
+}
+
+func newSourceVerifier(args argument) *sourceVerifier {
+	ssn := session.Must(session.NewSession(&aws.Config{Region: aws.String(args.awsRegion)}))
+
+	return &sourceVerifier{
+		ctx:               args.ctx,
+		buckets:           functions.SplitList(args.allowedSourceBuckets),
+		ownerPrincipalIDs: functions.SplitList(args.allowedOwnerPrincipalIDs),
+		regions:           functions.SplitList(args.allowedRegions),
+		verifyExists:      args.verifyObjectExists,
+		s3svc:             s3.New(ssn),
+	}
+}
+
+// enabled returns true if any check is configured.
+func (x *sourceVerifier) enabled() bool {
+	return len(x.buckets) > 0 || len(x.ownerPrincipalIDs) > 0 || len(x.regions) > 0 || x.verifyExists
+}
+
+// contains returns true if list is empty (no restriction) or has v.
+func contains(list []string, v string) bool {
+	if len(list) == 0 {
+		return true
+	}
+	for _, s := range list {
+		if s == v {
+			return true
+		}
+	}
+	return false
+}
+
+// Verify returns a reason why the S3 record is not allowed. An empty
+// reason means the record passed all checks.
+func (x *sourceVerifier) Verify(s3record events.S3EventRecord) (string, error) {
+	bucket := s3record.S3.Bucket.Name
+
+	if !contains(x.buckets, bucket) {
+		return fmt.Sprintf("Bucket '%s' is not allowed", bucket), nil
+	}
+
+	principalID := s3record.S3.Bucket.OwnerIdentity.PrincipalID
+	if !contains(x.ownerPrincipalIDs, principalID) {
+		return fmt.Sprintf("Principal ID of bucket owner '%s' is not allowed", principalID), nil
+	}
+
+	if !contains(x.regions, s3record.AWSRegion) {
+		return fmt.Sprintf("Region '%s' is not allowed", s3record.AWSRegion), nil
+	}
+
+	// Removed object does not exist by nature. HeadObject of delete marker
+	// version also fails with 405.
+	if x.verifyExists && !strings.HasPrefix(s3record.EventName, "ObjectRemoved:") {
+		input := &s3.HeadObjectInput{
+			Bucket: aws.String(bucket),
+			Key:    aws.String(functions.DecodeObjectKey(s3record.S3.Object.Key)),
+		}
+		if s3record.S3.Object.VersionID != "" {
+			input.VersionId = aws.String(s3record.S3.Object.VersionID)
+		}
+
+		if _, err := x.s3svc.HeadObjectWithContext(x.ctx, input); err != nil {
+			if aerr, ok := err.(awserr.Error); ok && aerr.Code() == "NotFound" {
+				return "Object does not exist", nil
+			}
+			return "", errors.Wrap(err, "Fail to get object metadata")
+		}
+	}
+
+	return "", nil
+}
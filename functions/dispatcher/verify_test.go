@@ -0,0 +1,74 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestS3Record(eventName, bucket, ownerID, region string) events.S3EventRecord {
+	var s3record events.S3EventRecord
+	s3record.EventName = eventName
+	s3record.AWSRegion = region
+	s3record.S3.Bucket.Name = bucket
+	s3record.S3.Bucket.OwnerIdentity.PrincipalID = ownerID
+	s3record.S3.Object.Key = "dir/a.json"
+	return s3record
+}
+
+func TestVerify(t *testing.T) {
+	verifier := &sourceVerifier{
+		ctx:               context.Background(),
+		buckets:           []string{"bucket-a", "bucket-b"},
+		ownerPrincipalIDs: []string{"OWNER1"},
+		regions:           []string{"ap-northeast-1"},
+	}
+	assert.True(t, verifier.enabled())
+
+	reason, err := verifier.Verify(newTestS3Record("ObjectCreated:Put", "bucket-b", "OWNER1", "ap-northeast-1"))
+	assert.NoError(t, err)
+	assert.Equal(t, "", reason)
+
+	reason, err = verifier.Verify(newTestS3Record("ObjectCreated:Put", "bucket-c", "OWNER1", "ap-northeast-1"))
+	assert.NoError(t, err)
+	assert.Equal(t, "Bucket 'bucket-c' is not allowed", reason)
+
+	reason, err = verifier.Verify(newTestS3Record("ObjectCreated:Put", "bucket-a", "OWNER2", "ap-northeast-1"))
+	assert.NoError(t, err)
+	assert.Equal(t, "Principal ID of bucket owner 'OWNER2' is not allowed", reason)
+
+	reason, err = verifier.Verify(newTestS3Record("ObjectCreated:Put", "bucket-a", "OWNER1", "us-east-1"))
+	assert.NoError(t, err)
+	assert.Equal(t, "Region 'us-east-1' is not allowed", reason)
+}
+
+func TestVerifyNoRestriction(t *testing.T) {
+	verifier := &sourceVerifier{ctx: context.Background()}
+	assert.False(t, verifier.enabled())
+
+	reason, err := verifier.Verify(newTestS3Record("ObjectCreated:Put", "bucket", "OWNER", "us-east-1"))
+	assert.NoError(t, err)
+	assert.Equal(t, "", reason)
+}
+
+func TestVerifyRemovedObject(t *testing.T) {
+	// Existence of removed object is not checked, then S3 is not called.
+	verifier := &sourceVerifier{
+		ctx:          context.Background(),
+		buckets:      []string{"bucket"},
+		verifyExists: true,
+	}
+
+	for _, eventName := range []string{"ObjectRemoved:Delete", "ObjectRemoved:DeleteMarkerCreated"} {
+		reason, err := verifier.Verify(newTestS3Record(eventName, "bucket", "OWNER", "us-east-1"))
+		assert.NoError(t, err)
+		assert.Equal(t, "", reason)
+	}
+
+	// Restriction is still applied to removal event.
+	reason, err := verifier.Verify(newTestS3Record("ObjectRemoved:Delete", "other", "OWNER", "us-east-1"))
+	assert.NoError(t, err)
+	assert.Equal(t, "Bucket 'other' is not allowed", reason)
+}
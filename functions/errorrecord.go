@@ -0,0 +1,173 @@
+package functions
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/pkg/errors"
+)
+
+// Units of retry for S3 event that had multiple records.
+const (
+	// RetryUnitObject invokes target Lambda per object.
+	RetryUnitObject = "object"
+	// RetryUnitGroup invokes target Lambda with the original event once.
+	RetryUnitGroup = "group"
+)
+
+// Values of retry_status. Only the records that have retry_status are in
+// RetryIndexName.
+const (
+	// RetryStatusScheduled is the record that waits for retry.
+	RetryStatusScheduled = "scheduled"
+	// RetryStatusLeased is the record that a Sweeper is retrying. It is
+	// scheduled again if the lease expires.
+	RetryStatusLeased = "leased"
+)
+
+// RetryIndexName is a name of global secondary index of ErrorTable to query
+// due records by retry_status and next_retry_at.
+const RetryIndexName = "retry_index"
+
+// Values of resolution, how the resolved record was resolved.
+const (
+	// ResolutionRetried is the record resolved by success of retry.
+	ResolutionRetried = "retried"
+	// ResolutionObsolete is the record resolved without retry because the
+	// object was deleted, superseded or too old.
+	ResolutionObsolete = "obsolete"
+)
+
+// HistoryEntry is a failure of the object. An error record has entries of
+// recent failures in History.
+type HistoryEntry struct {
+	Timestamp    time.Time `dynamo:"timestamp" json:"timestamp"`
+	RequestID    string    `dynamo:"request_id" json:"request_id"`
+	ErrorMessage string    `dynamo:"error_message" json:"error_message"`
+	Attempt      int       `dynamo:"attempt" json:"attempt"`
+	Qualifier    string    `dynamo:"qualifier" json:"qualifier"`
+	// Target is ARN of Lambda that handled the attempt.
+	Target string `dynamo:"target" json:"target"`
+}
+
+// RetryPolicy is an effective retry policy applied to the error record.
+// Durations are seconds.
+type RetryPolicy struct {
+	Route       string `dynamo:"route" json:"route"`
+	ErrorClass  string `dynamo:"error_class" json:"error_class"`
+	MaxRetry    int    `dynamo:"max_retry" json:"max_retry"`
+	BackoffBase int    `dynamo:"backoff_base" json:"backoff_base"`
+	BackoffCap  int    `dynamo:"backoff_cap" json:"backoff_cap"`
+	MinDelay    int    `dynamo:"min_delay" json:"min_delay"`
+	RetryWindow int    `dynamo:"retry_window" json:"retry_window"`
+}
+
+// ErrorRecord is a record of ErrorTable. It is error information from target
+// Lambda, not from Chamber functions.
+type ErrorRecord struct {
+	S3Key        string    `dynamo:"s3key" json:"s3key"`
+	OccurredAt   time.Time `dynamo:"occurred_at" json:"occurred_at"`
+	RequestID    string    `dynamo:"request_id" json:"request_id"`
+	ErrorMessage string    `dynamo:"error_message" json:"error_message"`
+	S3Event      []byte    `dynamo:"s3event" json:"-"`
+	ErrorCount   int       `dynamo:"error_count" json:"error_count"`
+	ErrorCode    string    `dynamo:"error_code" json:"error_code"`
+	LogGroup     string    `dynamo:"log_group" json:"log_group"`
+	LogStream    string    `dynamo:"log_stream" json:"log_stream"`
+
+	// Retried is true if retry was in flight. It is used only by records
+	// created before State was introduced.
+	Retried bool `dynamo:"retried" json:"retried"`
+
+	History    []HistoryEntry `dynamo:"history" json:"history"`
+	ErrorClass string         `dynamo:"error_class" json:"error_class"`
+
+	// ProcessedIDs is IDs of recent failures handled by Catcher to skip
+	// duplicated delivery of the same failure.
+	ProcessedIDs []string `dynamo:"processed_ids" json:"processed_ids"`
+
+	// Fields of lifecycle. Version is counted up by every state transition.
+	State          string    `dynamo:"state" json:"state"`
+	StateReason    string    `dynamo:"state_reason" json:"state_reason"`
+	StateChangedAt time.Time `dynamo:"state_changed_at" json:"state_changed_at"`
+	Version        int       `dynamo:"version" json:"version"`
+
+	// Fields of retry schedule. NextRetryAt is unix time. RetryTarget is ARN
+	// of Lambda to invoke for the retry, chosen by Route.
+	RetryStatus string       `dynamo:"retry_status" json:"retry_status"`
+	NextRetryAt int64        `dynamo:"next_retry_at,omitempty" json:"next_retry_at,omitempty"`
+	RetryTarget string       `dynamo:"retry_target" json:"retry_target"`
+	Route       string       `dynamo:"route" json:"route"`
+	RetryPolicy *RetryPolicy `dynamo:"retry_policy" json:"retry_policy"`
+
+	// Fields of lease taken by Sweeper. LeaseExpiresAt is unix time.
+	LeaseOwner     string `dynamo:"lease_owner" json:"lease_owner"`
+	LeaseExpiresAt int64  `dynamo:"lease_expires_at,omitempty" json:"lease_expires_at,omitempty"`
+
+	// Fields of the last retry. RetryRequestID is request ID of invocation by
+	// Sweeper to match on-success record of Lambda Destinations.
+	RetryRequestID string    `dynamo:"retry_request_id" json:"retry_request_id"`
+	RetriedAt      time.Time `dynamo:"retried_at,omitempty" json:"retried_at,omitempty"`
+
+	// Fields of success that Catcher received while the record was leased,
+	// before RetryRequestID was saved. Sweeper resolves the record on release
+	// of the lease if SuccessRequestID is of the retry.
+	SuccessRequestID string    `dynamo:"success_request_id" json:"success_request_id"`
+	SucceededAt      time.Time `dynamo:"succeeded_at,omitempty" json:"succeeded_at,omitempty"`
+
+	// Fields of resolved record. TimeToRecovery is seconds from the first
+	// failure to success of retry.
+	Resolution     string    `dynamo:"resolution" json:"resolution"`
+	ResolvedAt     time.Time `dynamo:"resolved_at,omitempty" json:"resolved_at,omitempty"`
+	TimeToRecovery int64     `dynamo:"time_to_recovery,omitempty" json:"time_to_recovery,omitempty"`
+
+	// ArchiveLocation is S3 URL of archive of parked record.
+	ArchiveLocation string `dynamo:"archive_location" json:"archive_location"`
+	// RequeuedAt is time when the exhausted record was requeued by deploy of
+	// target Lambda.
+	RequeuedAt time.Time `dynamo:"requeued_at,omitempty" json:"requeued_at,omitempty"`
+
+	// Fields of S3 event that has multiple records. GroupEvent is the
+	// original event and S3Event has only the record of S3Key.
+	GroupID    string `dynamo:"group_id" json:"group_id"`
+	GroupIndex int    `dynamo:"group_index" json:"group_index"`
+	GroupSize  int    `dynamo:"group_size" json:"group_size"`
+	GroupEvent []byte `dynamo:"group_event" json:"-"`
+
+	// Fields available only with Lambda Destinations
+	ErrorType              string   `dynamo:"error_type" json:"error_type"`
+	StackTrace             []string `dynamo:"stack_trace" json:"stack_trace"`
+	Condition              string   `dynamo:"condition" json:"condition"`
+	ApproximateInvokeCount int      `dynamo:"approximate_invoke_count" json:"approximate_invoke_count"`
+	FunctionArn            string   `dynamo:"function_arn" json:"function_arn"`
+	ExecutedVersion        string   `dynamo:"executed_version" json:"executed_version"`
+}
+
+// IsGroupFollower returns true if the record is a member of group other than
+// the first one (the leader). Only the leader retries the group when
+// retryUnit is RetryUnitGroup.
+func (x *ErrorRecord) IsGroupFollower(retryUnit string) bool {
+	return retryUnit == RetryUnitGroup && len(x.GroupEvent) > 0 && x.GroupIndex != 0
+}
+
+// RetryEvent returns S3 event to invoke target Lambda for retry. It is the
+// original event for the group leader with RetryUnitGroup, or the event that
+// has only the record of the object.
+func (x *ErrorRecord) RetryEvent(retryUnit string) (*events.S3Event, error) {
+	raw := x.S3Event
+	if retryUnit == RetryUnitGroup && len(x.GroupEvent) > 0 {
+		raw = x.GroupEvent
+	}
+
+	var s3event events.S3Event
+	if err := json.Unmarshal(raw, &s3event); err != nil {
+		return nil, errors.Wrap(err, "Fail to parse S3 event in error record")
+	}
+
+	if len(s3event.Records) == 0 {
+		return nil, errors.New("No S3 record in error record")
+	}
+
+	return &s3event, nil
+}
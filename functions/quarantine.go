@@ -0,0 +1,198 @@
+package functions
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/google/uuid"
+	"github.com/guregu/dynamo"
+	"github.com/pkg/errors"
+)
+
+// Kinds of QuarantineRecord
+const (
+	// QuarantineMalformed is a Kinesis record that can not be parsed.
+	QuarantineMalformed = "malformed"
+	// QuarantineUnverified is a S3 record that failed source verification.
+	QuarantineUnverified = "unverified"
+	// QuarantineFailed is a S3 record that target Lambda failed to process
+	// in serialized dispatch.
+	QuarantineFailed = "failed"
+)
+
+// QuarantineRecord is a record of QuarantineTable. It keeps data that was
+// not dispatched to target Lambda and the reason. Data is original data of
+// Kinesis record for QuarantineMalformed and S3 event that has only the
+// record for QuarantineUnverified and QuarantineFailed, and it can be put
+// into the stream again. Data over the item size limit is saved to
+// QuarantineBucket instead, and DataBucket and DataKey point it.
+type QuarantineRecord struct {
+	ID             string    `dynamo:"id"`
+	Kind           string    `dynamo:"kind"`
+	Reason         string    `dynamo:"reason"`
+	S3Key          string    `dynamo:"s3key"`
+	Data           []byte    `dynamo:"data"`
+	EventSourceArn string    `dynamo:"event_source_arn"`
+	ShardID        string    `dynamo:"shard_id"`
+	SequenceNumber string    `dynamo:"sequence_number"`
+	PartitionKey   string    `dynamo:"partition_key"`
+	ArrivalTime    time.Time `dynamo:"arrival_time"`
+	QuarantinedAt  time.Time `dynamo:"quarantined_at"`
+
+	DataSize   int    `dynamo:"data_size"`
+	DataBucket string `dynamo:"data_bucket"`
+	DataKey    string `dynamo:"data_key"`
+}
+
+// Limits of QuarantineRecord to keep it under the item size limit of
+// DynamoDB (400KB). Reason may have a large error payload of target Lambda
+// and it is truncated. A Kinesis record can be up to 1MB.
+const (
+	maxQuarantineDataSize   = 350 * 1024
+	maxQuarantineReasonSize = 4 * 1024
+)
+
+// NewQuarantineRecord creates a QuarantineRecord with metadata of Kinesis
+// record.
+func NewQuarantineRecord(kind, reason string, record events.KinesisEventRecord) *QuarantineRecord {
+	rec := &QuarantineRecord{
+		Kind:           kind,
+		Reason:         reason,
+		Data:           record.Kinesis.Data,
+		EventSourceArn: record.EventSourceArn,
+		SequenceNumber: record.Kinesis.SequenceNumber,
+		PartitionKey:   record.Kinesis.PartitionKey,
+		ArrivalTime:    record.Kinesis.ApproximateArrivalTimestamp.UTC(),
+	}
+
+	// EventID has format of "{shardId}:{sequenceNumber}"
+	if pos := strings.Index(record.EventID, ":"); pos > 0 {
+		rec.ShardID = record.EventID[:pos]
+	}
+
+	return rec
+}
+
+// Quarantine is an accessor of QuarantineTable and QuarantineBucket.
+type Quarantine struct {
+	table  dynamo.Table
+	s3Svc  *s3.S3
+	bucket string
+}
+
+// NewQuarantine creates a Quarantine accessor. bucket is S3 bucket to save
+// large data.
+func NewQuarantine(region, tableName, bucket string) *Quarantine {
+	ssn := session.Must(session.NewSession(&aws.Config{Region: aws.String(region)}))
+	db := dynamo.New(ssn)
+	return &Quarantine{
+		table:  db.Table(tableName),
+		s3Svc:  s3.New(ssn),
+		bucket: bucket,
+	}
+}
+
+// Put saves the record with a new ID and current time. Data over the limit is
+// saved to the bucket, and Reason over the limit is truncated.
+func (x *Quarantine) Put(ctx context.Context, rec *QuarantineRecord) error {
+	rec.ID = uuid.New().String()
+	rec.QuarantinedAt = time.Now().UTC()
+	rec.DataSize = len(rec.Data)
+	rec.Reason = TruncateString(rec.Reason, maxQuarantineReasonSize)
+
+	if len(rec.Data) > maxQuarantineDataSize {
+		if x.bucket == "" {
+			return errors.Errorf("Data of %d bytes is too large for QuarantineTable and no bucket is set", len(rec.Data))
+		}
+
+		key := "quarantine/" + rec.ID
+		_, err := x.s3Svc.PutObjectWithContext(ctx, &s3.PutObjectInput{
+			Bucket: aws.String(x.bucket),
+			Key:    aws.String(key),
+			Body:   bytes.NewReader(rec.Data),
+		})
+		if err != nil {
+			return errors.Wrap(err, "Fail to put quarantine data")
+		}
+
+		rec.Data = nil
+		rec.DataBucket = x.bucket
+		rec.DataKey = key
+	}
+
+	if err := x.table.Put(rec).RunWithContext(ctx); err != nil {
+		return errors.Wrap(err, "Fail to put quarantine record")
+	}
+
+	return nil
+}
+
+// Get retrieves a record by ID.
+func (x *Quarantine) Get(ctx context.Context, id string) (*QuarantineRecord, error) {
+	var rec QuarantineRecord
+	if err := x.table.Get("id", id).OneWithContext(ctx, &rec); err != nil {
+		return nil, errors.Wrapf(err, "Fail to get quarantine record: %s", id)
+	}
+
+	return &rec, nil
+}
+
+// List retrieves all records.
+func (x *Quarantine) List(ctx context.Context) ([]*QuarantineRecord, error) {
+	var records []*QuarantineRecord
+	if err := x.table.Scan().AllWithContext(ctx, &records); err != nil {
+		return nil, errors.Wrap(err, "Fail to scan quarantine records")
+	}
+
+	return records, nil
+}
+
+// Data returns data of the record, that is read from the bucket if it was
+// saved there.
+func (x *Quarantine) Data(ctx context.Context, rec *QuarantineRecord) ([]byte, error) {
+	if rec.DataKey == "" {
+		return rec.Data, nil
+	}
+
+	out, err := x.s3Svc.GetObjectWithContext(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(rec.DataBucket),
+		Key:    aws.String(rec.DataKey),
+	})
+	if err != nil {
+		return nil, errors.Wrapf(err, "Fail to get quarantine data: s3://%s/%s", rec.DataBucket, rec.DataKey)
+	}
+	defer out.Body.Close()
+
+	data, err := ioutil.ReadAll(out.Body)
+	if err != nil {
+		return nil, errors.Wrap(err, "Fail to read quarantine data")
+	}
+
+	return data, nil
+}
+
+// Delete removes the record, and its data in the bucket.
+func (x *Quarantine) Delete(ctx context.Context, rec *QuarantineRecord) error {
+	if err := x.table.Delete("id", rec.ID).RunWithContext(ctx); err != nil {
+		return errors.Wrapf(err, "Fail to delete quarantine record: %s", rec.ID)
+	}
+
+	if rec.DataKey != "" {
+		_, err := x.s3Svc.DeleteObjectWithContext(ctx, &s3.DeleteObjectInput{
+			Bucket: aws.String(rec.DataBucket),
+			Key:    aws.String(rec.DataKey),
+		})
+		if err != nil {
+			return errors.Wrapf(err, "Fail to delete quarantine data: s3://%s/%s", rec.DataBucket, rec.DataKey)
+		}
+	}
+
+	return nil
+}
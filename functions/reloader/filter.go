@@ -0,0 +1,87 @@
+package main
+
+import (
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/pkg/errors"
+
+	"github.com/m-mizutani/chamber/functions"
+)
+
+// Event names of DynamoDB stream record.
+const (
+	eventInsert = "INSERT"
+	eventModify = "MODIFY"
+	eventRemove = "REMOVE"
+)
+
+// Reasons to skip DynamoDB stream record. Skipped records are counted by the
+// reason in result.
+const (
+	// skipRemoved is a deleted error record.
+	skipRemoved = "removed"
+	// skipNotWaiting is a record that is not waiting for retry schedule, e.g.
+	// scheduled, retrying or resolved.
+	skipNotWaiting = "not_waiting"
+	// skipUnchanged is a change that does not mean a new failure, e.g.
+	// appending history.
+	skipUnchanged = "unchanged"
+	// skipGroupMember is a member of group that is retried by the leader.
+	skipGroupMember = "group_member"
+)
+
+// isWaiting returns true if the record is a failure waiting for retry
+// schedule.
+func isWaiting(rec *functions.ErrorRecord) bool {
+	return rec.CurrentState() == functions.StatePending && rec.RetryStatus == ""
+}
+
+// inspect returns error record of the stream record if the Reloader should
+// act on the change. The record is
+//   - a new failure that is waiting for retry schedule, or
+//   - a record that became exhausted and should be parked.
+//
+// Otherwise, skip is a reason to skip the stream record. Changes by the
+// Reloader itself and Sweeper are skipped because the record is not waiting
+// for schedule after the change.
+func inspect(dynamoRecord events.DynamoDBEventRecord) (rec *functions.ErrorRecord, skip string, err error) {
+	switch dynamoRecord.EventName {
+	case eventInsert, eventModify:
+	case eventRemove:
+		return nil, skipRemoved, nil
+	default:
+		return nil, "", errors.Errorf("Unknown event name: '%s'", dynamoRecord.EventName)
+	}
+
+	var newRecord, oldRecord functions.ErrorRecord
+	if err := functions.UnmarshalStreamImage(dynamoRecord.Change.NewImage, &newRecord); err != nil {
+		return nil, "", err
+	}
+	if newRecord.S3Key == "" {
+		return nil, "", errors.New("Fail to get s3key from Dynamodb Record")
+	}
+	if dynamoRecord.EventName == eventModify {
+		if err := functions.UnmarshalStreamImage(dynamoRecord.Change.OldImage, &oldRecord); err != nil {
+			return nil, "", err
+		}
+	}
+
+	if newRecord.CurrentState() == functions.StateExhausted {
+		if dynamoRecord.EventName == eventModify && oldRecord.CurrentState() == functions.StateExhausted {
+			return &newRecord, skipUnchanged, nil
+		}
+		return &newRecord, "", nil
+	}
+
+	if !isWaiting(&newRecord) {
+		return &newRecord, skipNotWaiting, nil
+	}
+
+	// A new failure counts up error_count and version by state transition
+	// even if the record was waiting already.
+	if dynamoRecord.EventName == eventModify && isWaiting(&oldRecord) &&
+		oldRecord.Version == newRecord.Version && oldRecord.ErrorCount == newRecord.ErrorCount {
+		return &newRecord, skipUnchanged, nil
+	}
+
+	return &newRecord, "", nil
+}
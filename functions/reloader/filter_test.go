@@ -0,0 +1,113 @@
+package main
+
+import (
+	"strconv"
+	"testing"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/m-mizutani/chamber/functions"
+)
+
+func newTestImage(state string, version, errorCount int, retryStatus string) map[string]events.DynamoDBAttributeValue {
+	image := map[string]events.DynamoDBAttributeValue{
+		"s3key":       events.NewStringAttribute("bucket/dir/a.json"),
+		"state":       events.NewStringAttribute(state),
+		"version":     events.NewNumberAttribute(strconv.Itoa(version)),
+		"error_count": events.NewNumberAttribute(strconv.Itoa(errorCount)),
+	}
+	if retryStatus != "" {
+		image["retry_status"] = events.NewStringAttribute(retryStatus)
+	}
+	return image
+}
+
+func newTestStreamRecord(eventName string, oldImage, newImage map[string]events.DynamoDBAttributeValue) events.DynamoDBEventRecord {
+	var record events.DynamoDBEventRecord
+	record.EventName = eventName
+	record.Change.OldImage = oldImage
+	record.Change.NewImage = newImage
+	return record
+}
+
+func TestInspect(t *testing.T) {
+	pending := newTestImage(functions.StatePending, 2, 2, "")
+
+	testCases := []struct {
+		name   string
+		record events.DynamoDBEventRecord
+		act    bool
+		skip   string
+	}{
+		{
+			name:   "insert of new failure",
+			record: newTestStreamRecord(eventInsert, nil, newTestImage(functions.StatePending, 1, 1, "")),
+			act:    true,
+		},
+		{
+			name:   "modify with identical images",
+			record: newTestStreamRecord(eventModify, pending, newTestImage(functions.StatePending, 2, 2, "")),
+			skip:   skipUnchanged,
+		},
+		{
+			name:   "modify by new failure of waiting record",
+			record: newTestStreamRecord(eventModify, pending, newTestImage(functions.StatePending, 3, 3, "")),
+			act:    true,
+		},
+		{
+			name:   "modify by schedule of Reloader",
+			record: newTestStreamRecord(eventModify, pending, newTestImage(functions.StatePending, 2, 2, functions.RetryStatusScheduled)),
+			skip:   skipNotWaiting,
+		},
+		{
+			name: "modify from parked to pending",
+			record: newTestStreamRecord(eventModify,
+				newTestImage(functions.StateParked, 5, 4, ""),
+				newTestImage(functions.StatePending, 6, 0, "")),
+			act: true,
+		},
+		{
+			name:   "modify from pending to exhausted",
+			record: newTestStreamRecord(eventModify, pending, newTestImage(functions.StateExhausted, 3, 2, "")),
+			act:    true,
+		},
+		{
+			name: "modify of exhausted record",
+			record: newTestStreamRecord(eventModify,
+				newTestImage(functions.StateExhausted, 3, 2, ""),
+				newTestImage(functions.StateExhausted, 3, 2, "")),
+			skip: skipUnchanged,
+		},
+		{
+			name:   "remove",
+			record: newTestStreamRecord(eventRemove, pending, nil),
+			skip:   skipRemoved,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			rec, skip, err := inspect(tc.record)
+			assert.NoError(t, err)
+			assert.Equal(t, tc.skip, skip)
+			if tc.act {
+				assert.NotNil(t, rec)
+				assert.Equal(t, "bucket/dir/a.json", rec.S3Key)
+			}
+			if tc.record.EventName == eventRemove {
+				assert.Nil(t, rec)
+			}
+		})
+	}
+}
+
+func TestInspectInvalidRecord(t *testing.T) {
+	_, _, err := inspect(newTestStreamRecord("UNKNOWN", nil, nil))
+	assert.Error(t, err)
+
+	image := newTestImage(functions.StatePending, 1, 1, "")
+	delete(image, "s3key")
+	_, _, err = inspect(newTestStreamRecord(eventInsert, nil, image))
+	assert.Error(t, err)
+}
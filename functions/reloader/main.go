@@ -2,10 +2,11 @@ package main
 
 import (
 	"context"
-	"encoding/json"
+	"fmt"
 	"os"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/aws/aws-lambda-go/events"
 	"github.com/aws/aws-lambda-go/lambda"
@@ -22,16 +23,31 @@ var logger = functions.NewLogger()
 
 // argment is a parameters to invoke Catcher
 type argument struct {
-	LambdaArn string
-	MaxRetry  string
-	AwsRegion string
-	Event     events.DynamoDBEvent
+	MaxRetry         string
+	AwsRegion        string
+	RetryUnit        string
+	ErrorClassConfig string
+	BackoffBase      string
+	BackoffCap       string
+	TargetArn        string
+	RouteConfig      string
+	// FallbackTargetArns is comma separated ARNs of targets of RouteConfig.
+	FallbackTargetArns string
+
+	ArchiveBucket      string
+	ArchivePrefix      string
+	ExhaustedActionArn string
+
+	Event events.DynamoDBEvent
+	ctx   context.Context
 }
 
 // result is a returned value of Catcher Lambda function.
 type result struct {
-	Result string      `json:"result"`
-	Errors []errorInfo `json:"errors"`
+	Result            string                       `json:"result"`
+	Errors            []errorInfo                  `json:"errors"`
+	Skipped           map[string]int               `json:"skipped"`
+	BatchItemFailures []functions.BatchItemFailure `json:"batchItemFailures"`
 }
 
 type errorInfo struct {
@@ -39,117 +55,315 @@ type errorInfo struct {
 	Error error
 }
 
-func handleRecord(dynamoRecord events.DynamoDBEventRecord, invoker functions.LambdaInvoker, maxRetry uint64) (string, error) {
-	var s3key string
+// transientError is an error that may be resolved by retry of the stream
+// record, e.g. failure of DynamoDB request. Other errors such as parse error
+// of the record are deterministic and the record is dropped.
+type transientError struct {
+	error
+}
+
+func isTransient(err error) bool {
+	_, ok := err.(*transientError)
+	return ok
+}
+
+// retryConfig is configuration of retry parsed from argument.
+type retryConfig struct {
+	maxRetry  uint64
+	retryUnit string
+	classes   *functions.ErrorClassConfig
+	routes    *functions.RouteConfig
+	targetArn string
+	backoff   functions.Backoff
+	parker    *parker
+}
+
+// policy resolves effective retry policy of the record. Policy of the error
+// class overrides parameters of the stack, and policy of the route overrides
+// both of them.
+func (x *retryConfig) policy(rec *functions.ErrorRecord, route *functions.Route) *functions.RetryPolicy {
+	policy := &functions.RetryPolicy{
+		MaxRetry:    int(x.maxRetry),
+		BackoffBase: int(x.backoff.Base / time.Second),
+		BackoffCap:  int(x.backoff.Cap / time.Second),
+	}
+
+	if rec.ErrorClass != "" {
+		if p, ok := x.classes.Policy(rec.ErrorClass); ok {
+			policy.ErrorClass = rec.ErrorClass
+			policy.MaxRetry = p.MaxRetry
+			policy.MinDelay = p.Delay
+		}
+	}
+
+	if route != nil {
+		policy.Route = route.Name
+		if p := route.Policy; p != nil {
+			if p.MaxRetry != nil {
+				policy.MaxRetry = *p.MaxRetry
+			}
+			if p.BackoffBase != nil {
+				policy.BackoffBase = *p.BackoffBase
+			}
+			if p.BackoffCap != nil {
+				policy.BackoffCap = *p.BackoffCap
+			}
+			policy.RetryWindow = p.RetryWindow
+		}
+	}
+
+	return policy
+}
+
+// exhausted returns reason why the record should not be retried anymore by
+// the policy, or empty string.
+func exhausted(rec *functions.ErrorRecord, policy *functions.RetryPolicy) string {
+	if rec.ErrorCount > policy.MaxRetry {
+		return fmt.Sprintf("error_count %d exceeds max retry %d", rec.ErrorCount, policy.MaxRetry)
+	}
 
+	// Requeued record has a new window from the requeue.
+	since, origin := rec.OccurredAt, "the first failure"
+	if rec.RequeuedAt.After(since) {
+		since, origin = rec.RequeuedAt, "the requeue"
+	}
+
+	window := time.Duration(policy.RetryWindow) * time.Second
+	if window > 0 && !since.IsZero() && time.Since(since) > window {
+		return fmt.Sprintf("Retry window %s from %s elapsed", window, origin)
+	}
+
+	return ""
+}
+
+// handleRecord schedules retry of the error record by setting next_retry_at
+// and retry_status. Sweeper invokes target Lambda when the retry is due.
+func handleRecord(ctx context.Context, dynamoRecord events.DynamoDBEventRecord, config *retryConfig) (s3key, skip string, err error) {
 	// Setup dynamoDB accessor
 	tableArnSeq := strings.Split(dynamoRecord.EventSourceArn, "/")
 	if len(tableArnSeq) != 4 {
 		logger.WithField("eventSourceArn", dynamoRecord.EventSourceArn).
 			Error("Invalid EventSourceArn format")
-		return s3key, errors.New("Invalid EventSourceArn format")
+		return s3key, "", errors.New("Invalid EventSourceArn format")
 	}
 
 	db := dynamo.New(session.New(), &aws.Config{Region: aws.String(dynamoRecord.AWSRegion)})
 	table := db.Table(tableArnSeq[1])
 
-	// Retrieve S3 key
-	if newKey, ok := dynamoRecord.Change.NewImage["s3key"]; ok {
-		s3key = newKey.String()
-	} else {
-		return s3key, errors.New("Fail to get s3key from Dynamodb Record")
+	target, skip, err := inspect(dynamoRecord)
+	if target != nil {
+		s3key = target.S3Key
 	}
+	if err != nil || skip != "" {
+		return s3key, skip, err
+	}
+	rec := *target
 
-	// Retrieve error count.
-	if newCount, ok := dynamoRecord.Change.NewImage["error_count"]; ok {
-		count, err := newCount.Integer()
-		if err != nil {
-			return s3key, errors.Wrap(err, "Fail to get error count")
-		}
-
-		if uint64(count) > maxRetry {
-			logger.WithFields(logrus.Fields{
-				"count":    count,
-				"maxRetry": maxRetry,
-				"s3key":    s3key,
-			}).Info("Skip retrying for S3 key")
-
-			return s3key, nil
-		}
-	} else {
-		return s3key, errors.New("Fail to get s3event from Dynamodb Record")
+	if rec.CurrentState() == functions.StateExhausted {
+		return s3key, "", config.parker.park(ctx, table, &rec)
 	}
 
-	if newEvent, ok := dynamoRecord.Change.NewImage["s3event"]; ok {
-		var s3event events.S3Event
-		err := json.Unmarshal(newEvent.Binary(), &s3event)
+	route := config.routes.Match(s3key)
+	policy := config.policy(&rec, route)
+	if reason := exhausted(&rec, policy); reason != "" {
+		logger.WithFields(logrus.Fields{
+			"count":  rec.ErrorCount,
+			"policy": policy,
+			"reason": reason,
+			"s3key":  s3key,
+		}).Info("Skip retrying for S3 key")
+
+		update, err := functions.Transit(table, &rec, functions.StateExhausted, reason)
 		if err != nil {
-			return s3key, errors.Wrap(err, "Fail to parse s3event in dynamoDB record")
+			return s3key, "", err
 		}
-
-		if len(s3event.Records) != 1 {
-			return s3key, errors.New("Invalid S3 record set length, must be 1")
+		err = update.Set("retry_policy", policy).RunWithContext(ctx)
+		if err != nil && !functions.IsConditionalCheckFailed(err) {
+			return s3key, "", &transientError{errors.Wrap(err, "Fail to update state to exhausted")}
 		}
 
-		s3record := s3event.Records[0]
+		return s3key, "", nil
+	}
 
+	s3event, err := rec.RetryEvent(functions.RetryUnitObject)
+	if err != nil {
+		return s3key, "", err
+	}
+	if len(s3event.Records) != 1 {
+		return s3key, "", errors.New("Invalid S3 record set length, must be 1")
+	}
+	if canonicalKey := functions.S3Key(s3event.Records[0]); canonicalKey != s3key {
+		// Records created before key normalization have encoded key.
 		logger.WithFields(logrus.Fields{
-			"s3record": s3record,
-		}).Info("Invoking lambda")
+			"s3key":     s3key,
+			"canonical": canonicalKey,
+		}).Warn("s3key is not canonical form")
+	}
 
-		// Lock if can
-		err = table.Update("s3key", s3key).Set("retried", true).
-			If("retried = ?", false).Run()
-		if err != nil {
-			return s3key, errors.Wrap(err, "Fail to update target record")
-		}
+	if rec.IsGroupFollower(config.retryUnit) {
+		logger.WithField("s3key", s3key).Info("Skip group member, the leader retries the group")
+		return s3key, skipGroupMember, nil
+	}
 
-		err = invoker.Invoke(s3record)
-		if err != nil {
-			return s3key, errors.Wrap(err, "Fail to invoke Lambda")
+	backoff := functions.Backoff{
+		Base: time.Duration(policy.BackoffBase) * time.Second,
+		Cap:  time.Duration(policy.BackoffCap) * time.Second,
+	}
+	delay := backoff.Delay(rec.ErrorCount)
+	if minDelay := time.Duration(policy.MinDelay) * time.Second; delay < minDelay {
+		delay = minDelay
+	}
+	nextRetryAt := time.Now().Add(delay)
+
+	// Escalate to fallback target of the route by number of failures.
+	retryTarget := route.Target(rec.ErrorCount, config.targetArn)
+
+	update := table.Update("s3key", s3key).
+		Set("retry_status", functions.RetryStatusScheduled).
+		Set("next_retry_at", nextRetryAt.Unix()).
+		Set("retry_target", retryTarget).
+		Set("retry_policy", policy).
+		If("attribute_not_exists(retry_status)")
+	if route != nil {
+		update = update.Set("route", route.Name)
+	}
+	err = functions.IfVersion(update, &rec).RunWithContext(ctx)
+	if err != nil {
+		if functions.IsConditionalCheckFailed(err) {
+			// The record was scheduled or modified by others, and the
+			// change is handled by its own stream record.
+			return s3key, "", nil
 		}
+		return s3key, "", &transientError{errors.Wrap(err, "Fail to schedule retry")}
 	}
 
-	return s3key, nil
+	logger.WithFields(logrus.Fields{
+		"s3key":       s3key,
+		"count":       rec.ErrorCount,
+		"nextRetryAt": nextRetryAt,
+		"target":      retryTarget,
+	}).Info("Scheduled retry")
+
+	return s3key, "", nil
 }
 
 func handler(args argument) (result, error) {
-	var res result
+	res := result{Skipped: map[string]int{}}
 
 	logger.WithFields(logrus.Fields{
 		"args": args,
 	}).Info("Start function")
 
-	invoker := functions.NewLambdaInvoker(args.AwsRegion, args.LambdaArn)
 	maxRetry, err := strconv.ParseUint(args.MaxRetry, 10, 64)
 	if err != nil {
 		return res, errors.Wrapf(err, "Fail to parse MaxRetry: '%s'", args.MaxRetry)
 	}
+	if args.RetryUnit != functions.RetryUnitObject && args.RetryUnit != functions.RetryUnitGroup {
+		return res, errors.Errorf("Invalid RetryUnit: '%s'", args.RetryUnit)
+	}
+	classes, err := functions.ParseErrorClassConfig(args.ErrorClassConfig)
+	if err != nil {
+		return res, err
+	}
+	routes, err := functions.ParseRouteConfig(args.RouteConfig)
+	if err != nil {
+		return res, err
+	}
+	if err := routes.CheckTargets(functions.SplitList(args.FallbackTargetArns)); err != nil {
+		return res, err
+	}
+	if err := routes.CheckMinFailures(classes.MaxRetry(int(maxRetry))); err != nil {
+		return res, err
+	}
+	backoffBase, err := strconv.ParseUint(args.BackoffBase, 10, 64)
+	if err != nil {
+		return res, errors.Wrapf(err, "Fail to parse BackoffBase: '%s'", args.BackoffBase)
+	}
+	backoffCap, err := strconv.ParseUint(args.BackoffCap, 10, 64)
+	if err != nil {
+		return res, errors.Wrapf(err, "Fail to parse BackoffCap: '%s'", args.BackoffCap)
+	}
+	parker, err := newParker(args)
+	if err != nil {
+		return res, err
+	}
 
-	for _, dynamoRecord := range args.Event.Records {
-		s3key, err := handleRecord(dynamoRecord, invoker, maxRetry)
+	config := &retryConfig{
+		maxRetry:  maxRetry,
+		retryUnit: args.RetryUnit,
+		classes:   classes,
+		routes:    routes,
+		targetArn: args.TargetArn,
+		backoff: functions.Backoff{
+			Base: time.Duration(backoffBase) * time.Second,
+			Cap:  time.Duration(backoffCap) * time.Second,
+		},
+		parker: parker,
+	}
+
+	for i, dynamoRecord := range args.Event.Records {
+		if !functions.HasTimeLeft(args.ctx) {
+			for _, remain := range args.Event.Records[i:] {
+				res.BatchItemFailures = append(res.BatchItemFailures, functions.BatchItemFailure{
+					ItemIdentifier: remain.Change.SequenceNumber,
+				})
+			}
+			logger.WithField("remaining", len(res.BatchItemFailures)).
+				Warn("Stop processing because deadline is approaching")
+			break
+		}
 
+		s3key, skip, err := handleRecord(args.ctx, dynamoRecord, config)
+		if skip != "" {
+			res.Skipped[skip]++
+		}
 		if err != nil {
 			logger.WithFields(logrus.Fields{
 				"dynamodb_record": dynamoRecord,
 				"s3key":           s3key,
 				"error":           err,
+				"transient":       isTransient(err),
 			}).Error("Fail to handle dynamodb record")
 
 			res.Errors = append(res.Errors, errorInfo{s3key, err})
+
+			// Only transient error is retried by DynamoDB stream.
+			if isTransient(err) {
+				res.BatchItemFailures = append(res.BatchItemFailures, functions.BatchItemFailure{
+					ItemIdentifier: dynamoRecord.Change.SequenceNumber,
+				})
+			}
 		}
 	}
 
+	logger.WithFields(logrus.Fields{
+		"records": len(args.Event.Records),
+		"skipped": res.Skipped,
+		"errors":  len(res.Errors),
+	}).Info("Done")
+
 	return res, nil
 }
 
 func main() {
 	lambda.Start(func(ctx context.Context, event events.DynamoDBEvent) (result, error) {
 		args := argument{
-			LambdaArn: os.Getenv("TARGET_LAMBDA_ARN"),
-			MaxRetry:  os.Getenv("MAX_RETRY"),
-			AwsRegion: os.Getenv("AWS_REGION"),
-			Event:     event,
+			MaxRetry:         os.Getenv("MAX_RETRY"),
+			AwsRegion:        os.Getenv("AWS_REGION"),
+			RetryUnit:        os.Getenv("RETRY_UNIT"),
+			ErrorClassConfig: os.Getenv("ERROR_CLASS_CONFIG"),
+			BackoffBase:      os.Getenv("RETRY_BACKOFF_BASE"),
+			BackoffCap:       os.Getenv("RETRY_BACKOFF_CAP"),
+			TargetArn:        os.Getenv("TARGET_LAMBDA_ARN"),
+			RouteConfig:      os.Getenv("ROUTE_CONFIG"),
+
+			FallbackTargetArns: os.Getenv("FALLBACK_TARGET_ARNS"),
+
+			ArchiveBucket:      os.Getenv("ARCHIVE_BUCKET"),
+			ArchivePrefix:      os.Getenv("ARCHIVE_PREFIX"),
+			ExhaustedActionArn: os.Getenv("EXHAUSTED_ACTION_ARN"),
+			Event:              event,
+			ctx:                ctx,
 		}
 
 		return handler(args)
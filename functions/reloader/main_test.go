@@ -0,0 +1,38 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/m-mizutani/chamber/functions"
+)
+
+func TestExhaustedByCount(t *testing.T) {
+	policy := &functions.RetryPolicy{MaxRetry: 3}
+
+	assert.Equal(t, "", exhausted(&functions.ErrorRecord{ErrorCount: 3}, policy))
+	assert.Equal(t, "error_count 4 exceeds max retry 3", exhausted(&functions.ErrorRecord{ErrorCount: 4}, policy))
+}
+
+func TestExhaustedByWindow(t *testing.T) {
+	policy := &functions.RetryPolicy{MaxRetry: 10, RetryWindow: 3600}
+
+	rec := &functions.ErrorRecord{ErrorCount: 1, OccurredAt: time.Now().Add(-30 * time.Minute)}
+	assert.Equal(t, "", exhausted(rec, policy))
+
+	rec.OccurredAt = time.Now().Add(-2 * time.Hour)
+	assert.Equal(t, "Retry window 1h0m0s from the first failure elapsed", exhausted(rec, policy))
+
+	// Requeued record has a new window from the requeue.
+	rec.RequeuedAt = time.Now().Add(-30 * time.Minute)
+	assert.Equal(t, "", exhausted(rec, policy))
+
+	rec.RequeuedAt = time.Now().Add(-90 * time.Minute)
+	assert.Equal(t, "Retry window 1h0m0s from the requeue elapsed", exhausted(rec, policy))
+
+	// 0 is unlimited.
+	policy.RetryWindow = 0
+	assert.Equal(t, "", exhausted(rec, policy))
+}
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/sns"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	"github.com/guregu/dynamo"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+
+	"github.com/m-mizutani/chamber/functions"
+)
+
+// parker moves exhausted error records to parked state. The record is
+// archived to S3 and exhaustion action (SNS notification or SQS message for
+// review) is executed before the state transition.
+type parker struct {
+	s3Svc         *s3.S3
+	snsSvc        *sns.SNS
+	sqsSvc        *sqs.SQS
+	archiveBucket string
+	archivePrefix string
+	actionArn     string
+	// actionQueueURL is URL of SQS queue of actionArn resolved at the first
+	// action.
+	actionQueueURL string
+}
+
+// archivedRecord is an object of archive of parked record.
+type archivedRecord struct {
+	Record     *functions.ErrorRecord `json:"record"`
+	S3Event    json.RawMessage        `json:"s3event"`
+	GroupEvent json.RawMessage        `json:"group_event,omitempty"`
+	ParkedAt   time.Time              `json:"parked_at"`
+}
+
+// exhaustedNotice is a message of exhaustion action.
+type exhaustedNotice struct {
+	S3Key           string          `json:"s3key"`
+	ErrorCount      int             `json:"error_count"`
+	ErrorMessage    string          `json:"error_message"`
+	ErrorClass      string          `json:"error_class"`
+	Reason          string          `json:"reason"`
+	ArchiveLocation string          `json:"archive_location"`
+	S3Event         json.RawMessage `json:"s3event"`
+}
+
+// parseActionArn returns service and region of ARN of exhaustion action such
+// as "arn:aws:sqs:ap-northeast-1:1234567890:queue". Any partition, e.g.
+// "aws-cn", is accepted.
+func parseActionArn(arn string) (string, string, error) {
+	seq := strings.Split(arn, ":")
+	if len(seq) != 6 || seq[0] != "arn" || (seq[2] != "sns" && seq[2] != "sqs") {
+		return "", "", errors.Errorf("Invalid ExhaustedActionArn, SNS topic or SQS queue is required: '%s'", arn)
+	}
+	return seq[2], seq[3], nil
+}
+
+func newParker(args argument) (*parker, error) {
+	ssn := session.Must(session.NewSession(&aws.Config{
+		Region: aws.String(args.AwsRegion),
+	}))
+
+	// The action is called in region of the topic or queue.
+	actionConfig := aws.NewConfig()
+	if arn := args.ExhaustedActionArn; arn != "" {
+		_, region, err := parseActionArn(arn)
+		if err != nil {
+			return nil, err
+		}
+		actionConfig = actionConfig.WithRegion(region)
+	}
+
+	return &parker{
+		s3Svc:         s3.New(ssn),
+		snsSvc:        sns.New(ssn, actionConfig),
+		sqsSvc:        sqs.New(ssn, actionConfig),
+		archiveBucket: args.ArchiveBucket,
+		archivePrefix: args.ArchivePrefix,
+		actionArn:     args.ExhaustedActionArn,
+	}, nil
+}
+
+// archive puts the record to S3 and returns the location. It does nothing if
+// archive bucket is not configured.
+func (x *parker) archive(ctx context.Context, rec *functions.ErrorRecord) (string, error) {
+	if x.archiveBucket == "" {
+		return "", nil
+	}
+
+	now := time.Now().UTC()
+	doc := archivedRecord{
+		Record:     rec,
+		S3Event:    rec.S3Event,
+		GroupEvent: rec.GroupEvent,
+		ParkedAt:   now,
+	}
+	if len(doc.GroupEvent) == 0 {
+		doc.GroupEvent = nil
+	}
+
+	raw, err := json.Marshal(doc)
+	if err != nil {
+		return "", errors.Wrap(err, "Fail to marshal archived record")
+	}
+
+	key := x.archivePrefix + rec.S3Key + "/" + now.Format("20060102T150405Z") + ".json"
+	_, err = x.s3Svc.PutObjectWithContext(ctx, &s3.PutObjectInput{
+		Bucket:      aws.String(x.archiveBucket),
+		Key:         aws.String(key),
+		Body:        bytes.NewReader(raw),
+		ContentType: aws.String("application/json"),
+	})
+	if err != nil {
+		return "", errors.Wrap(err, "Fail to archive parked record")
+	}
+
+	return fmt.Sprintf("s3://%s/%s", x.archiveBucket, key), nil
+}
+
+// queueURL returns URL of SQS queue of the action ARN. It is looked up by
+// GetQueueUrl because domain of the URL depends on partition.
+func (x *parker) queueURL(ctx context.Context) (string, error) {
+	if x.actionQueueURL != "" {
+		return x.actionQueueURL, nil
+	}
+
+	seq := strings.Split(x.actionArn, ":")
+	out, err := x.sqsSvc.GetQueueUrlWithContext(ctx, &sqs.GetQueueUrlInput{
+		QueueName:              aws.String(seq[5]),
+		QueueOwnerAWSAccountId: aws.String(seq[4]),
+	})
+	if err != nil {
+		return "", errors.Wrapf(err, "Fail to get URL of SQS queue: %s", x.actionArn)
+	}
+
+	x.actionQueueURL = aws.StringValue(out.QueueUrl)
+	return x.actionQueueURL, nil
+}
+
+// notify executes exhaustion action. SNS topic or SQS queue is chosen by
+// service of the action ARN. It does nothing if the ARN is not configured.
+func (x *parker) notify(ctx context.Context, rec *functions.ErrorRecord, reason, location string) error {
+	if x.actionArn == "" {
+		return nil
+	}
+
+	raw, err := json.Marshal(exhaustedNotice{
+		S3Key:           rec.S3Key,
+		ErrorCount:      rec.ErrorCount,
+		ErrorMessage:    rec.ErrorMessage,
+		ErrorClass:      rec.ErrorClass,
+		Reason:          reason,
+		ArchiveLocation: location,
+		S3Event:         rec.S3Event,
+	})
+	if err != nil {
+		return errors.Wrap(err, "Fail to marshal exhausted notice")
+	}
+
+	service, _, err := parseActionArn(x.actionArn)
+	if err != nil {
+		return err
+	}
+
+	switch service {
+	case "sns":
+		_, err = x.snsSvc.PublishWithContext(ctx, &sns.PublishInput{
+			TopicArn: aws.String(x.actionArn),
+			Subject:  aws.String("Chamber: retry exhausted"),
+			Message:  aws.String(string(raw)),
+		})
+	case "sqs":
+		url, uerr := x.queueURL(ctx)
+		if uerr != nil {
+			return uerr
+		}
+		_, err = x.sqsSvc.SendMessageWithContext(ctx, &sqs.SendMessageInput{
+			QueueUrl:    aws.String(url),
+			MessageBody: aws.String(string(raw)),
+		})
+	}
+
+	if err != nil {
+		return errors.Wrap(err, "Fail to execute exhausted action")
+	}
+
+	return nil
+}
+
+// park archives the exhausted record, executes exhaustion action and moves
+// the record to parked state. The record is parked again if the transition
+// fails, and then the action may be executed twice.
+func (x *parker) park(ctx context.Context, table dynamo.Table, rec *functions.ErrorRecord) error {
+	reason := rec.StateReason
+
+	location, err := x.archive(ctx, rec)
+	if err != nil {
+		return &transientError{err}
+	}
+
+	if err := x.notify(ctx, rec, reason, location); err != nil {
+		return &transientError{err}
+	}
+
+	update, err := functions.Transit(table, rec, functions.StateParked, "Parked: "+reason)
+	if err != nil {
+		return err
+	}
+
+	if location != "" {
+		update = update.Set("archive_location", location)
+	}
+
+	err = update.RunWithContext(ctx)
+	if err != nil {
+		if functions.IsConditionalCheckFailed(err) {
+			// The record was modified, e.g. a new failure came.
+			return nil
+		}
+		return &transientError{errors.Wrap(err, "Fail to update state to parked")}
+	}
+
+	logger.WithFields(logrus.Fields{
+		"s3key":    rec.S3Key,
+		"location": location,
+	}).Info("Parked error record")
+
+	return nil
+}
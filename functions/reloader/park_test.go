@@ -0,0 +1,33 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseActionArn(t *testing.T) {
+	service, region, err := parseActionArn("arn:aws:sqs:ap-northeast-1:1234567890:queue")
+	assert.NoError(t, err)
+	assert.Equal(t, "sqs", service)
+	assert.Equal(t, "ap-northeast-1", region)
+
+	service, region, err = parseActionArn("arn:aws-cn:sns:cn-north-1:1234567890:topic")
+	assert.NoError(t, err)
+	assert.Equal(t, "sns", service)
+	assert.Equal(t, "cn-north-1", region)
+}
+
+func TestParseActionArnInvalid(t *testing.T) {
+	for _, arn := range []string{
+		"",
+		"queue",
+		"arn:aws:lambda:ap-northeast-1:1234567890:function:target",
+		"arn:aws:s3:::bucket",
+		"arn:aws:sqs:ap-northeast-1:1234567890",
+		"https://sqs.ap-northeast-1.amazonaws.com/1234567890/queue",
+	} {
+		_, _, err := parseActionArn(arn)
+		assert.Error(t, err, arn)
+	}
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/lambda"
+	"github.com/guregu/dynamo"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+
+	"github.com/m-mizutani/chamber/functions"
+)
+
+// lastModifiedFormat is a format of LastModified of Lambda function.
+const lastModifiedFormat = "2006-01-02T15:04:05.000-0700"
+
+// deployRecord is the latest deploy of target Lambda seen by Requeuer. It is
+// saved as "deploy#{target}" record of RetryControlTable. Requeuing is true
+// until all records that failed before the deploy are requeued.
+type deployRecord struct {
+	PK         string    `dynamo:"pk"`
+	Version    string    `dynamo:"version"`
+	CodeSha256 string    `dynamo:"code_sha256"`
+	DeployedAt time.Time `dynamo:"deployed_at"`
+	DetectedAt time.Time `dynamo:"detected_at"`
+	Requeuing  bool      `dynamo:"requeuing"`
+}
+
+// currentDeploy gets version of target Lambda that is invoked by the ARN. A
+// qualified ARN by alias returns the version of the alias.
+func currentDeploy(ctx context.Context, svc *lambda.Lambda, target string) (*deployRecord, error) {
+	out, err := svc.GetFunctionConfigurationWithContext(ctx, &lambda.GetFunctionConfigurationInput{
+		FunctionName: aws.String(target),
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "Fail to get function configuration of target Lambda")
+	}
+
+	deployedAt, err := time.Parse(lastModifiedFormat, aws.StringValue(out.LastModified))
+	if err != nil {
+		return nil, errors.Wrapf(err, "Fail to parse LastModified: '%s'", aws.StringValue(out.LastModified))
+	}
+
+	return &deployRecord{
+		PK:         "deploy#" + target,
+		Version:    aws.StringValue(out.Version),
+		CodeSha256: aws.StringValue(out.CodeSha256),
+		DeployedAt: deployedAt.UTC(),
+	}, nil
+}
+
+// detectDeploy compares the current deploy with the last one seen and saves
+// it. A new deploy starts requeuing. The first deploy seen does not requeue
+// records that failed before Requeuer was installed.
+func detectDeploy(ctx context.Context, table dynamo.Table, current *deployRecord) (*deployRecord, error) {
+	var last deployRecord
+	err := table.Get("pk", current.PK).Consistent(true).OneWithContext(ctx, &last)
+	if err != nil && err != dynamo.ErrNotFound {
+		return nil, errors.Wrap(err, "Fail to get last deploy")
+	}
+
+	if err == nil && last.Version == current.Version && last.CodeSha256 == current.CodeSha256 {
+		return &last, nil
+	}
+
+	current.DetectedAt = time.Now().UTC()
+	current.Requeuing = err == nil
+	if err := table.Put(current).RunWithContext(ctx); err != nil {
+		return nil, errors.Wrap(err, "Fail to save deploy")
+	}
+
+	logger.WithFields(logrus.Fields{
+		"version":    current.Version,
+		"codeSha256": current.CodeSha256,
+		"deployedAt": current.DeployedAt,
+		"requeuing":  current.Requeuing,
+	}).Info("Detected new deploy of target Lambda")
+
+	return current, nil
+}
+
+// finishRequeue stops requeuing for the deploy. It does nothing if another
+// deploy was detected in the meantime.
+func finishRequeue(ctx context.Context, table dynamo.Table, deploy *deployRecord) error {
+	err := table.Update("pk", deploy.PK).
+		Set("requeuing", false).
+		If("code_sha256 = ? AND 'version' = ?", deploy.CodeSha256, deploy.Version).
+		RunWithContext(ctx)
+	if err != nil && !functions.IsConditionalCheckFailed(err) {
+		return errors.Wrap(err, "Fail to finish requeue")
+	}
+	return nil
+}
+
+// unqualifiedArn returns ARN of Lambda function without version or alias.
+func unqualifiedArn(functionArn string) string {
+	parts := strings.Split(functionArn, ":")
+	if len(parts) < 8 {
+		return functionArn
+	}
+	return strings.Join(parts[:7], ":")
+}
+
+// failedBefore returns true if the last failure of the record happened on
+// older version of target than the deploy. A failure on other Lambda, e.g.
+// fallback target of the route, is not fixed by the deploy.
+func failedBefore(rec *functions.ErrorRecord, deploy *deployRecord, target string) bool {
+	lastFailure := rec.OccurredAt
+	qualifier := rec.ExecutedVersion
+	lastTarget := rec.FunctionArn
+	if n := len(rec.History); n > 0 {
+		entry := rec.History[n-1]
+		if entry.Timestamp.After(lastFailure) {
+			lastFailure = entry.Timestamp
+		}
+		if entry.Qualifier != "" {
+			qualifier = entry.Qualifier
+		}
+		if entry.Target != "" {
+			lastTarget = entry.Target
+		}
+	}
+
+	if lastTarget != "" && unqualifiedArn(lastTarget) != unqualifiedArn(target) {
+		return false
+	}
+
+	if !lastFailure.Before(deploy.DeployedAt) {
+		return false
+	}
+
+	// $LATEST and alias do not tell the version, then only time is compared.
+	return qualifier != deploy.Version || deploy.Version == "$LATEST"
+}
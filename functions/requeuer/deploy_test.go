@@ -0,0 +1,70 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/m-mizutani/chamber/functions"
+)
+
+const testTarget = "arn:aws:lambda:ap-northeast-1:1234567890:function:target"
+
+func TestUnqualifiedArn(t *testing.T) {
+	assert.Equal(t, testTarget, unqualifiedArn(testTarget))
+	assert.Equal(t, testTarget, unqualifiedArn(testTarget+":3"))
+	assert.Equal(t, testTarget, unqualifiedArn(testTarget+":live"))
+}
+
+func TestFailedBefore(t *testing.T) {
+	deployedAt := time.Date(2019, 1, 2, 3, 4, 5, 0, time.UTC)
+	deploy := &deployRecord{Version: "4", DeployedAt: deployedAt}
+
+	rec := &functions.ErrorRecord{
+		OccurredAt:      deployedAt.Add(-time.Hour),
+		ExecutedVersion: "3",
+	}
+	assert.True(t, failedBefore(rec, deploy, testTarget))
+
+	// Failure on the deployed version is not fixed by the deploy.
+	rec.ExecutedVersion = "4"
+	assert.False(t, failedBefore(rec, deploy, testTarget))
+
+	// $LATEST does not tell the version, then only time is compared.
+	assert.True(t, failedBefore(rec, &deployRecord{Version: "$LATEST", DeployedAt: deployedAt}, testTarget))
+
+	rec.ExecutedVersion = "3"
+	rec.OccurredAt = deployedAt.Add(time.Minute)
+	assert.False(t, failedBefore(rec, deploy, testTarget))
+}
+
+func TestFailedBeforeHistory(t *testing.T) {
+	deployedAt := time.Date(2019, 1, 2, 3, 4, 5, 0, time.UTC)
+	deploy := &deployRecord{Version: "4", DeployedAt: deployedAt}
+
+	rec := &functions.ErrorRecord{
+		OccurredAt:      deployedAt.Add(-2 * time.Hour),
+		ExecutedVersion: "3",
+		FunctionArn:     testTarget + ":3",
+		History: []functions.HistoryEntry{
+			{Timestamp: deployedAt.Add(-time.Hour), Qualifier: "3", Target: testTarget + ":3"},
+		},
+	}
+	assert.True(t, failedBefore(rec, deploy, testTarget+":live"))
+
+	// The last retry failed after the deploy.
+	rec.History = append(rec.History, functions.HistoryEntry{
+		Timestamp: deployedAt.Add(time.Minute),
+		Qualifier: "4",
+		Target:    testTarget + ":4",
+	})
+	assert.False(t, failedBefore(rec, deploy, testTarget))
+
+	// The last retry failed on fallback target of the route.
+	rec.History[1] = functions.HistoryEntry{
+		Timestamp: deployedAt.Add(-time.Minute),
+		Target:    "arn:aws:lambda:ap-northeast-1:1234567890:function:fallback",
+	}
+	assert.False(t, failedBefore(rec, deploy, testTarget))
+}
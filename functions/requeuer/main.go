@@ -0,0 +1,181 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-lambda-go/lambda"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	lambdaSvc "github.com/aws/aws-sdk-go/service/lambda"
+	"github.com/guregu/dynamo"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+
+	"github.com/m-mizutani/chamber/functions"
+)
+
+var logger = functions.NewLogger()
+
+// result is a returned value of Requeuer Lambda function.
+type result struct {
+	Version   string      `json:"version"`
+	Requeuing bool        `json:"requeuing"`
+	Requeued  []string    `json:"requeued"`
+	Errors    []errorInfo `json:"errors"`
+}
+
+type errorInfo struct {
+	S3Key string `json:"s3key"`
+	Error string `json:"error"`
+}
+
+// argument is a parameters to invoke Requeuer
+type argument struct {
+	errorTable        string
+	retryControlTable string
+	lambdaArn         string
+	awsRegion         string
+	requeueRate       int
+	ctx               context.Context
+}
+
+// requeue moves the exhausted or parked record to pending state with reset
+// error_count. Then the Reloader schedules retry of the record again.
+func requeue(ctx context.Context, table dynamo.Table, rec *functions.ErrorRecord, deploy *deployRecord) (bool, error) {
+	reason := fmt.Sprintf("Requeued by deploy of version %s", deploy.Version)
+	update, err := functions.Transit(table, rec, functions.StatePending, reason)
+	if err != nil {
+		return false, err
+	}
+
+	err = update.
+		Set("error_count", 0).
+		Set("requeued_at", time.Now().UTC()).
+		RunWithContext(ctx)
+	if err != nil {
+		if functions.IsConditionalCheckFailed(err) {
+			// The record was modified, e.g. requeued manually.
+			return false, nil
+		}
+		return false, errors.Wrap(err, "Fail to requeue error record")
+	}
+
+	return true, nil
+}
+
+func handler(args argument) (result, error) {
+	var res result
+
+	if args.requeueRate <= 0 {
+		return res, errors.Errorf("Invalid RequeueRate: %d", args.requeueRate)
+	}
+
+	ssn := session.Must(session.NewSession(&aws.Config{Region: aws.String(args.awsRegion)}))
+	db := dynamo.New(ssn)
+	table := db.Table(args.errorTable)
+	controlTable := db.Table(args.retryControlTable)
+
+	current, err := currentDeploy(args.ctx, lambdaSvc.New(ssn), args.lambdaArn)
+	if err != nil {
+		return res, err
+	}
+
+	deploy, err := detectDeploy(args.ctx, controlTable, current)
+	if err != nil {
+		return res, err
+	}
+	res.Version = deploy.Version
+	res.Requeuing = deploy.Requeuing
+
+	if !deploy.Requeuing {
+		return res, nil
+	}
+
+	// Records are requeued at most requeueRate per run not to flood target
+	// Lambda just after the deploy. Requeued records are out of the filter,
+	// then the next run continues from the rest.
+	iter := table.Scan().
+		Filter("'state' IN (?, ?)", functions.StateExhausted, functions.StateParked).
+		Iter()
+	completed := true
+	for functions.HasTimeLeft(args.ctx) {
+		if len(res.Requeued) >= args.requeueRate {
+			completed = false
+			break
+		}
+
+		var rec functions.ErrorRecord
+		if !iter.NextWithContext(args.ctx, &rec) {
+			break
+		}
+
+		if !failedBefore(&rec, deploy, args.lambdaArn) {
+			continue
+		}
+
+		// A record that can not be requeued, e.g. by invalid transition or
+		// error left after retries of AWS SDK, is counted as handled not to
+		// keep requeuing forever.
+		requeued, err := requeue(args.ctx, table, &rec, deploy)
+		if err != nil {
+			logger.WithFields(logrus.Fields{
+				"error": err,
+				"s3key": rec.S3Key,
+			}).Error("Fail to requeue error record")
+			res.Errors = append(res.Errors, errorInfo{S3Key: rec.S3Key, Error: err.Error()})
+			continue
+		}
+		if requeued {
+			res.Requeued = append(res.Requeued, rec.S3Key)
+		}
+	}
+
+	if err := iter.Err(); err != nil {
+		return res, errors.Wrap(err, "Fail to scan exhausted records")
+	}
+	if !functions.HasTimeLeft(args.ctx) {
+		completed = false
+	}
+
+	if completed {
+		if err := finishRequeue(args.ctx, controlTable, deploy); err != nil {
+			return res, err
+		}
+		res.Requeuing = false
+	}
+
+	logger.WithFields(logrus.Fields{
+		"version":   res.Version,
+		"requeuing": res.Requeuing,
+		"requeued":  len(res.Requeued),
+		"errors":    len(res.Errors),
+	}).Info("Done")
+
+	return res, nil
+}
+
+func main() {
+	lambda.Start(func(ctx context.Context) (result, error) {
+		logger = functions.SetLoggerContext(logger, ctx)
+
+		requeueRate, err := strconv.Atoi(os.Getenv("REQUEUE_RATE"))
+		if err != nil {
+			return result{}, errors.Wrapf(err, "Fail to parse REQUEUE_RATE: '%s'", os.Getenv("REQUEUE_RATE"))
+		}
+
+		args := argument{
+			errorTable:        os.Getenv("ERROR_TABLE"),
+			retryControlTable: os.Getenv("RETRY_CONTROL_TABLE"),
+			lambdaArn:         os.Getenv("TARGET_LAMBDA_ARN"),
+			awsRegion:         os.Getenv("AWS_REGION"),
+			requeueRate:       requeueRate,
+			ctx:               ctx,
+		}
+
+		return handler(args)
+	})
+}
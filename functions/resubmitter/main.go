@@ -0,0 +1,161 @@
+package main
+
+import (
+	"context"
+	"os"
+	"strings"
+
+	"github.com/aws/aws-lambda-go/lambda"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/kinesis"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+
+	"github.com/m-mizutani/chamber/functions"
+)
+
+var logger = functions.NewLogger()
+
+// request is an input of Resubmitter that is invoked manually. Records of
+// IDs are resubmitted, or all records (of Kind if specified) if All is true.
+type request struct {
+	IDs  []string `json:"ids"`
+	All  bool     `json:"all"`
+	Kind string   `json:"kind"`
+}
+
+// result is a returned value of Resubmitter Lambda function.
+type result struct {
+	Resubmitted []string    `json:"resubmitted"`
+	Remaining   []string    `json:"remaining"`
+	Errors      []errorInfo `json:"errors"`
+}
+
+type errorInfo struct {
+	ID    string `json:"id"`
+	Error string `json:"error"`
+}
+
+// argument is a parameters to invoke Resubmitter
+type argument struct {
+	quarantineTable  string
+	quarantineBucket string
+	streamArn        string
+	awsRegion        string
+	request          request
+	ctx              context.Context
+}
+
+// streamName extracts stream name from ARN such as
+// "arn:aws:kinesis:ap-northeast-1:1234567890:stream/my-stream"
+func streamName(arn string) (string, error) {
+	pos := strings.Index(arn, ":stream/")
+	if pos < 0 {
+		return "", errors.Errorf("Invalid Kinesis stream ARN: %s", arn)
+	}
+	return arn[pos+len(":stream/"):], nil
+}
+
+func resubmit(args argument, kinesisSvc *kinesis.Kinesis, quarantine *functions.Quarantine, rec *functions.QuarantineRecord) error {
+	data, err := quarantine.Data(args.ctx, rec)
+	if err != nil {
+		return err
+	}
+
+	stream, err := streamName(args.streamArn)
+	if err != nil {
+		return err
+	}
+
+	partitionKey := rec.PartitionKey
+	if partitionKey == "" {
+		partitionKey = rec.ID
+	}
+
+	_, err = kinesisSvc.PutRecordWithContext(args.ctx, &kinesis.PutRecordInput{
+		StreamName:   aws.String(stream),
+		PartitionKey: aws.String(partitionKey),
+		Data:         data,
+	})
+	if err != nil {
+		return errors.Wrap(err, "Fail to put record into Kinesis stream")
+	}
+
+	return quarantine.Delete(args.ctx, rec)
+}
+
+func handler(args argument) (result, error) {
+	var res result
+
+	logger.WithField("request", args.request).Info("Start function")
+
+	quarantine := functions.NewQuarantine(args.awsRegion, args.quarantineTable, args.quarantineBucket)
+	ssn := session.Must(session.NewSession(&aws.Config{Region: aws.String(args.awsRegion)}))
+	kinesisSvc := kinesis.New(ssn)
+
+	var records []*functions.QuarantineRecord
+	if args.request.All {
+		all, err := quarantine.List(args.ctx)
+		if err != nil {
+			return res, err
+		}
+
+		for _, rec := range all {
+			if args.request.Kind == "" || args.request.Kind == rec.Kind {
+				records = append(records, rec)
+			}
+		}
+	} else {
+		for _, id := range args.request.IDs {
+			rec, err := quarantine.Get(args.ctx, id)
+			if err != nil {
+				res.Errors = append(res.Errors, errorInfo{id, err.Error()})
+				continue
+			}
+			records = append(records, rec)
+		}
+	}
+
+	for i, rec := range records {
+		if !functions.HasTimeLeft(args.ctx) {
+			for _, remain := range records[i:] {
+				res.Remaining = append(res.Remaining, remain.ID)
+			}
+			logger.WithField("remaining", len(res.Remaining)).
+				Warn("Stop resubmitting because deadline is approaching")
+			break
+		}
+
+		if err := resubmit(args, kinesisSvc, quarantine, rec); err != nil {
+			logger.WithFields(logrus.Fields{
+				"error": err,
+				"id":    rec.ID,
+			}).Error("Fail to resubmit record")
+
+			res.Errors = append(res.Errors, errorInfo{rec.ID, err.Error()})
+			continue
+		}
+
+		res.Resubmitted = append(res.Resubmitted, rec.ID)
+	}
+
+	return res, nil
+}
+
+func main() {
+	lambda.Start(func(ctx context.Context, req request) (result, error) {
+		logger = functions.SetLoggerContext(logger, ctx)
+
+		args := argument{
+			quarantineTable:  os.Getenv("QUARANTINE_TABLE"),
+			quarantineBucket: os.Getenv("QUARANTINE_BUCKET"),
+			streamArn:        os.Getenv("KINESIS_STREAM_ARN"),
+			awsRegion:        os.Getenv("AWS_REGION"),
+			request:          req,
+			ctx:              ctx,
+		}
+
+		return handler(args)
+	})
+}
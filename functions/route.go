@@ -0,0 +1,186 @@
+package functions
+
+import (
+	"encoding/json"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// RouteTarget is a target Lambda of retry in escalation chain.
+type RouteTarget struct {
+	TargetArn string `json:"target_arn"`
+	// MinFailures is number of failures of the object to use the target.
+	MinFailures int `json:"min_failures"`
+}
+
+// RoutePolicy overrides retry policy for the route. Nil field is not
+// overridden. Durations are seconds.
+type RoutePolicy struct {
+	MaxRetry    *int `json:"max_retry"`
+	BackoffBase *int `json:"backoff_base"`
+	BackoffCap  *int `json:"backoff_cap"`
+	// RetryWindow stops retry after the time from the first failure, or from
+	// requeue of the record. 0 is unlimited.
+	RetryWindow int `json:"retry_window"`
+}
+
+// Route is configuration of retry for objects of the bucket and prefix.
+// Empty bucket matches all buckets.
+type Route struct {
+	Name    string         `json:"name"`
+	Bucket  string         `json:"bucket"`
+	Prefix  string         `json:"prefix"`
+	Targets []*RouteTarget `json:"targets"`
+	Policy  *RoutePolicy   `json:"policy"`
+}
+
+// RouteConfig is configuration of routes of retry. It is given as JSON, e.g.
+//
+//	{
+//	  "routes": [
+//	    {
+//	      "name": "images",
+//	      "bucket": "my-bucket",
+//	      "prefix": "images/",
+//	      "targets": [
+//	        {"target_arn": "arn:aws:lambda:...:function:robust-resizer", "min_failures": 3},
+//	        {"target_arn": "arn:aws:lambda:...:function:store-raw", "min_failures": 5}
+//	      ],
+//	      "policy": {"max_retry": 10, "backoff_base": 60, "retry_window": 86400}
+//	    },
+//	    {"name": "scratch", "prefix": "tmp/", "policy": {"max_retry": 0}}
+//	  ]
+//	}
+//
+// The first route matched with s3key is used. Retry is invoked to the target
+// Lambda of the stack until the object fails min_failures times.
+type RouteConfig struct {
+	Routes []*Route `json:"routes"`
+}
+
+// ParseRouteConfig parses JSON configuration. Empty string returns empty
+// configuration that has no route.
+func ParseRouteConfig(raw string) (*RouteConfig, error) {
+	config := &RouteConfig{}
+	if raw == "" {
+		return config, nil
+	}
+
+	if err := json.Unmarshal([]byte(raw), config); err != nil {
+		return nil, errors.Wrap(err, "Fail to parse route config")
+	}
+
+	for i, route := range config.Routes {
+		if route.Name == "" {
+			route.Name = route.Bucket + "/" + route.Prefix
+		}
+
+		prev := 0
+		for _, target := range route.Targets {
+			if !isFunctionArn(target.TargetArn) {
+				return nil, errors.Errorf("Invalid target_arn of route %d: '%s'", i, target.TargetArn)
+			}
+			if target.MinFailures <= prev {
+				return nil, errors.Errorf("min_failures of route %d must be positive and ascending", i)
+			}
+			// The target is never used if retries are exhausted before it.
+			if p := route.Policy; p != nil && p.MaxRetry != nil && target.MinFailures > *p.MaxRetry {
+				return nil, errors.Errorf("min_failures of route %d must not exceed max_retry %d", i, *p.MaxRetry)
+			}
+			prev = target.MinFailures
+		}
+
+		if p := route.Policy; p != nil {
+			for _, v := range []*int{p.MaxRetry, p.BackoffBase, p.BackoffCap, &p.RetryWindow} {
+				if v != nil && *v < 0 {
+					return nil, errors.Errorf("Policy of route %d must not be negative", i)
+				}
+			}
+		}
+	}
+
+	return config, nil
+}
+
+// CheckMinFailures returns an error if a target of a route without max_retry
+// override is never used because retries are exhausted before it. maxRetry is
+// the largest max retry of the stack and error classes.
+func (x *RouteConfig) CheckMinFailures(maxRetry int) error {
+	for i, route := range x.Routes {
+		if p := route.Policy; p != nil && p.MaxRetry != nil {
+			continue // Checked by ParseRouteConfig
+		}
+		for _, target := range route.Targets {
+			if target.MinFailures > maxRetry {
+				return errors.Errorf("min_failures of route %d must not exceed max retry %d of the stack and error classes", i, maxRetry)
+			}
+		}
+	}
+	return nil
+}
+
+// CheckTargets returns an error if a target of the routes is not in arns,
+// ARNs of fallback targets of the stack. Invocation of the target is allowed
+// and its results are delivered to the Catcher only if it is in the list.
+func (x *RouteConfig) CheckTargets(arns []string) error {
+	for i, route := range x.Routes {
+		for _, target := range route.Targets {
+			found := false
+			for _, arn := range arns {
+				if arn == target.TargetArn {
+					found = true
+					break
+				}
+			}
+			if !found {
+				return errors.Errorf("target_arn of route %d is not in FallbackTargetArns: '%s'", i, target.TargetArn)
+			}
+		}
+	}
+	return nil
+}
+
+// isFunctionArn returns true if arn is ARN of Lambda function such as
+// "arn:aws:lambda:ap-northeast-1:1234567890:function:name". Any partition,
+// e.g. "aws-cn", is accepted.
+func isFunctionArn(arn string) bool {
+	seq := strings.Split(arn, ":")
+	return len(seq) >= 7 && len(seq) <= 8 && seq[0] == "arn" && seq[1] != "" &&
+		seq[2] == "lambda" && seq[5] == "function" && seq[6] != ""
+}
+
+func (x *Route) match(s3key string) bool {
+	if x.Bucket == "" {
+		// Prefix matches object key in any bucket.
+		idx := strings.Index(s3key, "/")
+		return idx >= 0 && strings.HasPrefix(s3key[idx+1:], x.Prefix)
+	}
+	return strings.HasPrefix(s3key, x.Bucket+"/"+x.Prefix)
+}
+
+// Match returns the first route matched with s3key, or nil.
+func (x *RouteConfig) Match(s3key string) *Route {
+	for _, route := range x.Routes {
+		if route.match(s3key) {
+			return route
+		}
+	}
+	return nil
+}
+
+// Target returns ARN of target Lambda for retry of the object that failed
+// errorCount times. It returns defaultArn if no fallback target applies.
+func (x *Route) Target(errorCount int, defaultArn string) string {
+	target := defaultArn
+	if x == nil {
+		return target
+	}
+
+	for _, t := range x.Targets {
+		if errorCount >= t.MinFailures {
+			target = t.TargetArn
+		}
+	}
+	return target
+}
@@ -0,0 +1,137 @@
+package functions
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRouteMatch(t *testing.T) {
+	route := &Route{Bucket: "my-bucket", Prefix: "images/"}
+	assert.True(t, route.match("my-bucket/images/a.png"))
+	assert.False(t, route.match("my-bucket/docs/a.pdf"))
+	assert.False(t, route.match("other-bucket/images/a.png"))
+	assert.False(t, route.match("my-bucket-2/images/a.png"))
+
+	// Empty bucket matches prefix in any bucket.
+	route = &Route{Prefix: "tmp/"}
+	assert.True(t, route.match("my-bucket/tmp/a"))
+	assert.True(t, route.match("other-bucket/tmp/a"))
+	assert.False(t, route.match("my-bucket/images/tmp/a"))
+	assert.False(t, route.match("tmp/a"))
+}
+
+func TestRouteConfigMatch(t *testing.T) {
+	images := &Route{Name: "images", Bucket: "my-bucket", Prefix: "images/"}
+	all := &Route{Name: "all", Bucket: "my-bucket"}
+	config := &RouteConfig{Routes: []*Route{images, all}}
+
+	// The first matched route is used.
+	assert.Equal(t, images, config.Match("my-bucket/images/a.png"))
+	assert.Equal(t, all, config.Match("my-bucket/docs/a.pdf"))
+	assert.Nil(t, config.Match("other-bucket/images/a.png"))
+}
+
+func TestRouteTarget(t *testing.T) {
+	route := &Route{
+		Targets: []*RouteTarget{
+			{TargetArn: "arn:robust", MinFailures: 3},
+			{TargetArn: "arn:store-raw", MinFailures: 5},
+		},
+	}
+
+	assert.Equal(t, "arn:default", route.Target(1, "arn:default"))
+	assert.Equal(t, "arn:default", route.Target(2, "arn:default"))
+	assert.Equal(t, "arn:robust", route.Target(3, "arn:default"))
+	assert.Equal(t, "arn:robust", route.Target(4, "arn:default"))
+	assert.Equal(t, "arn:store-raw", route.Target(5, "arn:default"))
+	assert.Equal(t, "arn:store-raw", route.Target(10, "arn:default"))
+
+	// No route is retried by the default target.
+	var none *Route
+	assert.Equal(t, "arn:default", none.Target(10, "arn:default"))
+}
+
+func TestParseRouteConfig(t *testing.T) {
+	config, err := ParseRouteConfig("")
+	assert.NoError(t, err)
+	assert.Equal(t, 0, len(config.Routes))
+
+	config, err = ParseRouteConfig(`{"routes": [
+		{"bucket": "my-bucket", "prefix": "images/",
+		 "targets": [{"target_arn": "arn:aws:lambda:ap-northeast-1:1234567890:function:robust", "min_failures": 3}],
+		 "policy": {"max_retry": 3}}
+	]}`)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(config.Routes))
+	assert.Equal(t, "my-bucket/images/", config.Routes[0].Name)
+	assert.Equal(t, 3, *config.Routes[0].Policy.MaxRetry)
+}
+
+func TestParseRouteConfigPartition(t *testing.T) {
+	for _, arn := range []string{
+		"arn:aws-cn:lambda:cn-north-1:1234567890:function:robust",
+		"arn:aws-us-gov:lambda:us-gov-west-1:1234567890:function:robust:prod",
+	} {
+		_, err := ParseRouteConfig(`{"routes": [{"targets": [{"target_arn": "` + arn + `", "min_failures": 3}]}]}`)
+		assert.NoError(t, err, arn)
+	}
+}
+
+func TestParseRouteConfigInvalid(t *testing.T) {
+	invalid := []string{
+		`{"routes": [`,
+		`{"routes": [{"targets": [{"target_arn": "robust", "min_failures": 3}]}]}`,
+		`{"routes": [{"targets": [{"target_arn": "arn:aws:sqs:ap-northeast-1:1234567890:robust", "min_failures": 3}]}]}`,
+		`{"routes": [{"targets": [{"target_arn": "arn:aws:lambda:ap-northeast-1:1234567890:layer:robust:1", "min_failures": 3}]}]}`,
+		`{"routes": [{"targets": [{"target_arn": "arn:aws:lambda:ap-northeast-1:1234567890:function:robust", "min_failures": 0}]}]}`,
+		`{"routes": [{"targets": [
+			{"target_arn": "arn:aws:lambda:ap-northeast-1:1234567890:function:robust", "min_failures": 3},
+			{"target_arn": "arn:aws:lambda:ap-northeast-1:1234567890:function:store-raw", "min_failures": 3}
+		]}]}`,
+		`{"routes": [{"policy": {"backoff_base": -1}}]}`,
+		// The target is never used because retries are exhausted before it.
+		`{"routes": [{
+			"targets": [{"target_arn": "arn:aws:lambda:ap-northeast-1:1234567890:function:robust", "min_failures": 4}],
+			"policy": {"max_retry": 3}
+		}]}`,
+	}
+
+	for _, raw := range invalid {
+		_, err := ParseRouteConfig(raw)
+		assert.Error(t, err, raw)
+	}
+}
+
+func TestRouteConfigCheckTargets(t *testing.T) {
+	config, err := ParseRouteConfig(`{"routes": [
+		{"prefix": "images/", "targets": [{"target_arn": "arn:aws:lambda:ap-northeast-1:1234567890:function:robust", "min_failures": 3}]},
+		{"prefix": "tmp/"}
+	]}`)
+	assert.NoError(t, err)
+
+	assert.NoError(t, config.CheckTargets([]string{
+		"arn:aws:lambda:ap-northeast-1:1234567890:function:store-raw",
+		"arn:aws:lambda:ap-northeast-1:1234567890:function:robust",
+	}))
+	assert.Error(t, config.CheckTargets(nil))
+	assert.Error(t, config.CheckTargets([]string{"arn:aws:lambda:ap-northeast-1:1234567890:function:robust:prod"}))
+
+	// No target is required for config without targets.
+	assert.NoError(t, (&RouteConfig{}).CheckTargets(nil))
+}
+
+func TestRouteConfigCheckMinFailures(t *testing.T) {
+	config, err := ParseRouteConfig(`{"routes": [
+		{"prefix": "images/", "targets": [{"target_arn": "arn:aws:lambda:ap-northeast-1:1234567890:function:robust", "min_failures": 5}]},
+		{"prefix": "docs/", "targets": [{"target_arn": "arn:aws:lambda:ap-northeast-1:1234567890:function:robust", "min_failures": 8}], "policy": {"max_retry": 10}}
+	]}`)
+	assert.NoError(t, err)
+
+	assert.NoError(t, config.CheckMinFailures(5))
+	assert.Error(t, config.CheckMinFailures(4))
+
+	// Route with max_retry override is not limited by the stack.
+	config.Routes = config.Routes[1:]
+	assert.NoError(t, config.CheckMinFailures(3))
+}
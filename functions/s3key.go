@@ -0,0 +1,26 @@
+package functions
+
+import (
+	"net/url"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+// DecodeObjectKey returns URL-decoded object key. S3 event notification
+// encodes object key as form value, e.g. a space is encoded to "+". The
+// encoded key is returned as it is if it can not be decoded.
+func DecodeObjectKey(key string) string {
+	decoded, err := url.QueryUnescape(key)
+	if err != nil {
+		return key
+	}
+	return decoded
+}
+
+// S3Key returns canonical key of the object in S3 record as
+// "{bucket}/{decoded object key}". It should be used for prefix matching and
+// for key of tables. Original S3 record keeps the encoded key and should be
+// used to replay the event exactly.
+func S3Key(s3record events.S3EventRecord) string {
+	return s3record.S3.Bucket.Name + "/" + DecodeObjectKey(s3record.S3.Object.Key)
+}
@@ -0,0 +1,25 @@
+package functions
+
+import (
+	"testing"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDecodeObjectKey(t *testing.T) {
+	assert.Equal(t, "dir/a b.json", DecodeObjectKey("dir/a+b.json"))
+	assert.Equal(t, "dir/a+b.json", DecodeObjectKey("dir/a%2Bb.json"))
+	assert.Equal(t, "日本/a.json", DecodeObjectKey("%E6%97%A5%E6%9C%AC/a.json"))
+	assert.Equal(t, "dir/a.json", DecodeObjectKey("dir/a.json"))
+	// Invalid escape is kept as it is.
+	assert.Equal(t, "dir/100%.json", DecodeObjectKey("dir/100%.json"))
+}
+
+func TestS3Key(t *testing.T) {
+	var s3record events.S3EventRecord
+	s3record.S3.Bucket.Name = "bucket"
+	s3record.S3.Object.Key = "dir/a+b%3D1.json"
+
+	assert.Equal(t, "bucket/dir/a b=1.json", S3Key(s3record))
+}
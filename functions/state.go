@@ -0,0 +1,122 @@
+package functions
+
+import (
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/guregu/dynamo"
+	"github.com/pkg/errors"
+)
+
+// Lifecycle states of error record.
+const (
+	// StatePending is a failure that waits for retry.
+	StatePending = "pending"
+	// StateRetrying is a retry in flight.
+	StateRetrying = "retrying"
+	// StateResolved is a failure that does not need retry anymore.
+	StateResolved = "resolved"
+	// StateExhausted is a failure that used up retries.
+	StateExhausted = "exhausted"
+	// StateIgnored is a failure that is ignored manually.
+	StateIgnored = "ignored"
+	// StateParked is a failure that is put aside for manual review.
+	StateParked = "parked"
+)
+
+// stateTransitions is allowed transitions from a state. A new failure of the
+// object moves the record to StatePending from any state.
+var stateTransitions = map[string][]string{
+	StatePending:   {StatePending, StateRetrying, StateResolved, StateExhausted, StateIgnored, StateParked},
+	StateRetrying:  {StatePending, StateResolved, StateExhausted, StateIgnored, StateParked},
+	StateResolved:  {StatePending},
+	StateExhausted: {StatePending, StateResolved, StateIgnored, StateParked},
+	StateIgnored:   {StatePending},
+	StateParked:    {StatePending, StateResolved, StateIgnored},
+}
+
+// ErrInvalidTransition is returned when the transition is not allowed.
+var ErrInvalidTransition = errors.New("Invalid state transition")
+
+// CanTransit returns true if the transition from -> to is allowed.
+func CanTransit(from, to string) bool {
+	for _, s := range stateTransitions[from] {
+		if s == to {
+			return true
+		}
+	}
+	return false
+}
+
+// CurrentState returns state of the record. Records created before the
+// lifecycle was introduced have no state, and the state is derived from
+// retried.
+func (x *ErrorRecord) CurrentState() string {
+	if x.State != "" {
+		return x.State
+	}
+	if x.Retried {
+		return StateRetrying
+	}
+	return StatePending
+}
+
+// InitState sets the initial state to a new record to be put.
+func (x *ErrorRecord) InitState(reason string) {
+	x.State = StatePending
+	x.StateReason = reason
+	x.StateChangedAt = time.Now().UTC()
+	x.Version = 1
+}
+
+// Transit returns an update of the record to change the state to `to`. The
+// update has a condition of version for optimistic concurrency and fails
+// with ConditionalCheckFailedException if the record was modified after it
+// was read. Caller can add other changes to the update before running it.
+func Transit(table dynamo.Table, rec *ErrorRecord, to, reason string) (*dynamo.Update, error) {
+	from := rec.CurrentState()
+	if !CanTransit(from, to) {
+		return nil, errors.Wrapf(ErrInvalidTransition, "%s -> %s", from, to)
+	}
+
+	update := table.Update("s3key", rec.S3Key).
+		Set("state", to).
+		Set("state_reason", reason).
+		Set("state_changed_at", time.Now().UTC()).
+		Add("version", 1)
+
+	return IfVersion(update, rec), nil
+}
+
+// ResolveRetry returns an update to resolve the record by success of the
+// retry invoked with requestID.
+func ResolveRetry(table dynamo.Table, rec *ErrorRecord, requestID string, succeededAt time.Time) (*dynamo.Update, error) {
+	update, err := Transit(table, rec, StateResolved, "Retry succeeded, request_id: "+requestID)
+	if err != nil {
+		return nil, err
+	}
+
+	return update.
+		Set("resolution", ResolutionRetried).
+		Set("resolved_at", succeededAt).
+		Set("time_to_recovery", int64(succeededAt.Sub(rec.OccurredAt).Seconds())), nil
+}
+
+// IfVersion adds a condition that the record has not been modified by state
+// transition after it was read.
+func IfVersion(update *dynamo.Update, rec *ErrorRecord) *dynamo.Update {
+	if rec.Version == 0 {
+		return update.If("attribute_not_exists(version)")
+	}
+	return update.If("version = ?", rec.Version)
+}
+
+// IsConditionalCheckFailed returns true if the update failed by condition,
+// e.g. the record was modified by others after it was read.
+func IsConditionalCheckFailed(err error) bool {
+	if aerr, ok := errors.Cause(err).(awserr.Error); ok {
+		return aerr.Code() == dynamodb.ErrCodeConditionalCheckFailedException
+	}
+	return false
+}
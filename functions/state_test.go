@@ -0,0 +1,58 @@
+package functions
+
+import (
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/guregu/dynamo"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCanTransit(t *testing.T) {
+	assert.True(t, CanTransit(StatePending, StateRetrying))
+	assert.True(t, CanTransit(StateRetrying, StateResolved))
+	assert.True(t, CanTransit(StateRetrying, StatePending))
+	assert.True(t, CanTransit(StateExhausted, StateParked))
+	assert.True(t, CanTransit(StateParked, StatePending))
+
+	assert.False(t, CanTransit(StateResolved, StateRetrying))
+	assert.False(t, CanTransit(StateIgnored, StateResolved))
+	assert.False(t, CanTransit(StateParked, StateRetrying))
+	assert.False(t, CanTransit(StateRetrying, StateRetrying))
+	assert.False(t, CanTransit("unknown", StatePending))
+
+	// A new failure moves the record to pending from any state.
+	for _, from := range []string{StatePending, StateRetrying, StateResolved, StateExhausted, StateIgnored, StateParked} {
+		assert.True(t, CanTransit(from, StatePending), from)
+	}
+}
+
+func TestCurrentState(t *testing.T) {
+	assert.Equal(t, StateResolved, (&ErrorRecord{State: StateResolved}).CurrentState())
+
+	// Records created before the lifecycle was introduced.
+	assert.Equal(t, StatePending, (&ErrorRecord{}).CurrentState())
+	assert.Equal(t, StateRetrying, (&ErrorRecord{Retried: true}).CurrentState())
+}
+
+func TestTransit(t *testing.T) {
+	db := dynamo.New(session.Must(session.NewSession()), &aws.Config{Region: aws.String("ap-northeast-1")})
+	table := db.Table("ErrorTable")
+
+	rec := &ErrorRecord{S3Key: "bucket/key"}
+	rec.InitState("Failed")
+	assert.Equal(t, StatePending, rec.State)
+	assert.Equal(t, 1, rec.Version)
+
+	update, err := Transit(table, rec, StateRetrying, "Retry")
+	assert.NoError(t, err)
+	assert.NotNil(t, update)
+
+	rec.State = StateResolved
+	update, err = Transit(table, rec, StateRetrying, "Retry")
+	assert.Nil(t, update)
+	assert.Equal(t, ErrInvalidTransition, errors.Cause(err))
+	assert.Contains(t, err.Error(), "resolved -> retrying")
+}
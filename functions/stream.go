@@ -0,0 +1,60 @@
+package functions
+
+import (
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/guregu/dynamo"
+	"github.com/pkg/errors"
+)
+
+// convertStreamAttribute converts attribute value of DynamoDB stream event to
+// attribute value of AWS SDK.
+func convertStreamAttribute(v events.DynamoDBAttributeValue) *dynamodb.AttributeValue {
+	av := &dynamodb.AttributeValue{}
+
+	switch v.DataType() {
+	case events.DataTypeBinary:
+		av.B = v.Binary()
+	case events.DataTypeBoolean:
+		av.BOOL = aws.Bool(v.Boolean())
+	case events.DataTypeBinarySet:
+		av.BS = v.BinarySet()
+	case events.DataTypeList:
+		for _, item := range v.List() {
+			av.L = append(av.L, convertStreamAttribute(item))
+		}
+	case events.DataTypeMap:
+		av.M = map[string]*dynamodb.AttributeValue{}
+		for key, item := range v.Map() {
+			av.M[key] = convertStreamAttribute(item)
+		}
+	case events.DataTypeNumber:
+		av.N = aws.String(v.Number())
+	case events.DataTypeNumberSet:
+		av.NS = aws.StringSlice(v.NumberSet())
+	case events.DataTypeNull:
+		av.NULL = aws.Bool(true)
+	case events.DataTypeString:
+		av.S = aws.String(v.String())
+	case events.DataTypeStringSet:
+		av.SS = aws.StringSlice(v.StringSet())
+	}
+
+	return av
+}
+
+// UnmarshalStreamImage decodes NewImage or OldImage of DynamoDB stream event
+// to out in the same way of guregu/dynamo, e.g. ErrorRecord.
+func UnmarshalStreamImage(image map[string]events.DynamoDBAttributeValue, out interface{}) error {
+	item := map[string]*dynamodb.AttributeValue{}
+	for key, value := range image {
+		item[key] = convertStreamAttribute(value)
+	}
+
+	if err := dynamo.UnmarshalItem(item, out); err != nil {
+		return errors.Wrap(err, "Fail to unmarshal stream image")
+	}
+
+	return nil
+}
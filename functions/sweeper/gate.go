@@ -0,0 +1,146 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/m-mizutani/chamber/functions"
+)
+
+// errRetryPaused is returned when no more retry is allowed in this run by
+// circuit breaker or retry budget.
+var errRetryPaused = errors.New("Retry is paused")
+
+// retryGate decides if the Sweeper can retry the next record of a target
+// Lambda by state of circuit breaker and retry budget. Only one probe retry is
+// allowed in half-open state.
+type retryGate struct {
+	ctx     context.Context
+	breaker *functions.CircuitBreaker
+	state   string
+	probing bool
+	// paused is true after retry budget is exhausted in the run.
+	paused bool
+}
+
+func newRetryGate(ctx context.Context, breaker *functions.CircuitBreaker) (*retryGate, error) {
+	state, err := breaker.State(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return &retryGate{ctx: ctx, breaker: breaker, state: state}, nil
+}
+
+// Allow returns errRetryPaused if no more retry is allowed by state of the
+// circuit seen by the run. It is checked before the lease of the next record.
+func (x *retryGate) Allow() error {
+	if x.paused || x.state == functions.CircuitOpen || (x.state == functions.CircuitHalfOpen && x.probing) {
+		return errRetryPaused
+	}
+	return nil
+}
+
+// Take takes budget of the retry of the leased record of s3key at now, and
+// the probe in half-open state. It returns errRetryPaused if the retry is not
+// allowed.
+func (x *retryGate) Take(s3key string, now time.Time) error {
+	if err := x.Allow(); err != nil {
+		return err
+	}
+
+	ok, err := x.breaker.TakeBudget(x.ctx, now)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		logger.Warn("Retry budget per hour is exhausted")
+		x.paused = true
+		return errRetryPaused
+	}
+
+	if x.state == functions.CircuitHalfOpen {
+		acquired, err := x.breaker.AcquireProbe(x.ctx, s3key)
+		if err != nil {
+			x.Cancel(s3key, now)
+			return err
+		}
+		if !acquired {
+			// Another Sweeper is probing.
+			x.Cancel(s3key, now)
+			x.state = functions.CircuitOpen
+			return errRetryPaused
+		}
+		x.probing = true
+	}
+
+	return nil
+}
+
+// Cancel gives back the budget and the probe taken by Take for the retry that
+// was not invoked. Error is only logged and the budget may be consumed.
+func (x *retryGate) Cancel(s3key string, now time.Time) {
+	if err := x.breaker.ReturnBudget(x.ctx, now); err != nil {
+		logger.WithField("error", err).Error("Fail to return retry budget")
+	}
+
+	if x.probing {
+		if err := x.breaker.ReleaseProbe(x.ctx, s3key); err != nil {
+			// Another probe is taken after ProbeTimeout.
+			logger.WithField("error", err).Error("Fail to release probe")
+		}
+		x.probing = false
+	}
+}
+
+// Done records the retry of s3key invoked at retriedAt. Error is not critical
+// for the retry and only logged.
+func (x *retryGate) Done(s3key string, retriedAt time.Time) {
+	if err := x.breaker.RecordRetry(x.ctx, retriedAt); err != nil {
+		logger.WithField("error", err).Error("Fail to record retry")
+	}
+
+	if x.probing {
+		logger.WithField("s3key", s3key).Info("Invoked probe retry")
+	}
+}
+
+// State returns state of circuit seen by the run.
+func (x *retryGate) State() string {
+	return x.state
+}
+
+// gates has retryGate per target Lambda of retry. Circuit and budget are
+// counted per target, then a broken fallback target does not pause retries to
+// the primary one.
+type gates struct {
+	args argument
+	pool map[string]*retryGate
+}
+
+// get returns gate of target. State of the circuit is read at the first call.
+func (x *gates) get(target string) (*retryGate, error) {
+	if gate, ok := x.pool[target]; ok {
+		return gate, nil
+	}
+
+	breaker := functions.NewCircuitBreaker(x.args.awsRegion, x.args.retryControlTable, target, x.args.circuitConfig)
+	gate, err := newRetryGate(x.args.ctx, breaker)
+	if err != nil {
+		return nil, err
+	}
+
+	x.pool[target] = gate
+	return gate, nil
+}
+
+// states returns state of circuit per target seen by the run.
+func (x *gates) states() map[string]string {
+	states := map[string]string{}
+	for target, gate := range x.pool {
+		states[target] = gate.State()
+	}
+	return states
+}
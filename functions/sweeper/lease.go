@@ -0,0 +1,216 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-lambda-go/lambdacontext"
+	"github.com/guregu/dynamo"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+
+	"github.com/m-mizutani/chamber/functions"
+)
+
+const (
+	// defaultLeaseDuration is used when deadline of the Sweeper is not
+	// available.
+	defaultLeaseDuration = 5 * time.Minute
+	// rollbackDelay postpones retry of the record that failed to invoke
+	// until the next run of Sweeper.
+	rollbackDelay = time.Minute
+)
+
+// retryLease is a lock of error record while a Sweeper retries it. The lease
+// has owner and expiry, then a record of crashed Sweeper can be recovered by
+// another Sweeper after the expiry.
+type retryLease struct {
+	ctx   context.Context
+	table dynamo.Table
+	owner string
+	until time.Time
+}
+
+func newRetryLease(ctx context.Context, table dynamo.Table) *retryLease {
+	x := &retryLease{
+		ctx:   ctx,
+		table: table,
+		owner: "N/A",
+		until: time.Now().Add(defaultLeaseDuration),
+	}
+
+	if lc, ok := lambdacontext.FromContext(ctx); ok {
+		x.owner = lc.AwsRequestID
+	}
+	// Lease expires after the Sweeper is timed out.
+	if deadline, ok := ctx.Deadline(); ok {
+		x.until = deadline.Add(time.Second)
+	}
+
+	return x
+}
+
+// acquire takes lease of scheduled record and changes the state to retrying.
+// It returns false if another Sweeper took the record. rec is updated to the
+// new record.
+func (x *retryLease) acquire(rec *functions.ErrorRecord) (bool, error) {
+	update, err := functions.Transit(x.table, rec, functions.StateRetrying, "Retry by Sweeper")
+	if err != nil {
+		return false, err
+	}
+
+	err = update.
+		Set("retry_status", functions.RetryStatusLeased).
+		Set("lease_owner", x.owner).
+		Set("lease_expires_at", x.until.Unix()).
+		If("retry_status = ?", functions.RetryStatusScheduled).
+		ValueWithContext(x.ctx, rec)
+	if err != nil {
+		if functions.IsConditionalCheckFailed(err) {
+			return false, nil
+		}
+		return false, errors.Wrap(err, "Fail to acquire lease of error record")
+	}
+
+	return true, nil
+}
+
+// release finishes the lease after target Lambda accepted the invocation. The
+// record stays in retrying state and is taken out of retry index. requestID
+// of the invocation is saved to confirm success of the retry, and target is
+// saved as the Lambda that handled the attempt. retriedAt is saved to count a
+// failure of the retry in the window of it. It returns the released record.
+func (x *retryLease) release(rec *functions.ErrorRecord, requestID, target string, retriedAt time.Time) (*functions.ErrorRecord, error) {
+	var released functions.ErrorRecord
+	err := x.table.Update("s3key", rec.S3Key).
+		Set("retry_request_id", requestID).
+		Set("retry_target", target).
+		Set("retried_at", retriedAt).
+		Remove("retry_status", "lease_owner", "lease_expires_at").
+		If("lease_owner = ?", x.owner).
+		ValueWithContext(x.ctx, &released)
+	if err != nil {
+		return nil, errors.Wrap(err, "Fail to release lease of error record")
+	}
+
+	return &released, nil
+}
+
+// resolveEarlySuccess resolves the released record by success that Catcher
+// received before the release. Members of the retried group are also
+// resolved.
+func (x *retryLease) resolveEarlySuccess(rec *functions.ErrorRecord, s3event *events.S3Event) error {
+	members := []*functions.ErrorRecord{rec}
+	for _, s3record := range s3event.Records {
+		s3key := functions.S3Key(s3record)
+		if rec.GroupID == "" || s3key == rec.S3Key {
+			continue
+		}
+
+		var member functions.ErrorRecord
+		err := x.table.Get("s3key", s3key).Consistent(true).OneWithContext(x.ctx, &member)
+		if err == dynamo.ErrNotFound {
+			continue
+		} else if err != nil {
+			return errors.Wrap(err, "Fail to get error record of group member")
+		}
+		if member.GroupID == rec.GroupID {
+			members = append(members, &member)
+		}
+	}
+
+	for _, member := range members {
+		update, err := functions.ResolveRetry(x.table, member, rec.SuccessRequestID, rec.SucceededAt)
+		if errors.Cause(err) == functions.ErrInvalidTransition {
+			// e.g. Already resolved.
+			continue
+		} else if err != nil {
+			return err
+		}
+
+		if err := update.RunWithContext(x.ctx); err != nil {
+			if functions.IsConditionalCheckFailed(err) {
+				// Modified by a new failure of the object.
+				continue
+			}
+			return errors.Wrap(err, "Fail to resolve error record")
+		}
+
+		logger.WithFields(logrus.Fields{
+			"s3key":     member.S3Key,
+			"requestID": rec.SuccessRequestID,
+		}).Info("Resolved error record by success before release")
+	}
+
+	return nil
+}
+
+// rollback returns the record to pending state to retry it again by the next
+// run of Sweeper. reason is why the record was not invoked.
+func (x *retryLease) rollback(rec *functions.ErrorRecord, reason string) error {
+	update, err := functions.Transit(x.table, rec, functions.StatePending, reason)
+	if err != nil {
+		return err
+	}
+
+	err = update.
+		Set("retry_status", functions.RetryStatusScheduled).
+		Set("next_retry_at", time.Now().Add(rollbackDelay).Unix()).
+		Remove("lease_owner", "lease_expires_at").
+		If("lease_owner = ?", x.owner).
+		RunWithContext(x.ctx)
+	if err != nil {
+		return errors.Wrap(err, "Fail to rollback lease of error record")
+	}
+
+	return nil
+}
+
+// recoverExpired schedules records of expired lease again. The owner of the
+// lease must have crashed or timed out before releasing it.
+func (x *retryLease) recoverExpired() ([]string, error) {
+	now := time.Now().Unix()
+
+	var records []functions.ErrorRecord
+	err := x.table.Get("retry_status", functions.RetryStatusLeased).
+		Index(functions.RetryIndexName).
+		Filter("lease_expires_at <= ?", now).
+		AllWithContext(x.ctx, &records)
+	if err != nil {
+		return nil, errors.Wrap(err, "Fail to query leased records")
+	}
+
+	var recovered []string
+	for i := range records {
+		rec := &records[i]
+		update, err := functions.Transit(x.table, rec, functions.StatePending, "Lease of "+rec.LeaseOwner+" expired")
+		if err != nil {
+			logger.WithFields(logrus.Fields{
+				"error": err,
+				"s3key": rec.S3Key,
+			}).Error("Fail to recover expired lease")
+			continue
+		}
+
+		err = update.
+			Set("retry_status", functions.RetryStatusScheduled).
+			Remove("lease_owner", "lease_expires_at").
+			If("retry_status = ? AND lease_expires_at <= ?", functions.RetryStatusLeased, now).
+			RunWithContext(x.ctx)
+		if err != nil {
+			if functions.IsConditionalCheckFailed(err) {
+				continue
+			}
+			return recovered, errors.Wrap(err, "Fail to recover expired lease")
+		}
+
+		logger.WithFields(logrus.Fields{
+			"s3key": rec.S3Key,
+			"owner": rec.LeaseOwner,
+		}).Warn("Recovered record of expired lease")
+		recovered = append(recovered, rec.S3Key)
+	}
+
+	return recovered, nil
+}
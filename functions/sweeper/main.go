@@ -0,0 +1,297 @@
+package main
+
+import (
+	"context"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-lambda-go/lambda"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/guregu/dynamo"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+
+	"github.com/m-mizutani/chamber/functions"
+)
+
+var logger = functions.NewLogger()
+
+// sweepBatchSize is a number of due records queried at once.
+const sweepBatchSize = 50
+
+// result is a returned value of Sweeper Lambda function.
+type result struct {
+	Circuits  map[string]string `json:"circuits"`
+	Invoked   []string          `json:"invoked"`
+	Obsolete  []string          `json:"obsolete"`
+	Recovered []string          `json:"recovered"`
+	Errors    []errorInfo       `json:"errors"`
+}
+
+type errorInfo struct {
+	S3Key string `json:"s3key"`
+	Error string `json:"error"`
+}
+
+// argument is a parameters to invoke Sweeper
+type argument struct {
+	errorTable        string
+	retryControlTable string
+	lambdaArn         string
+	awsRegion         string
+	retryUnit         string
+	circuitConfig     *functions.CircuitConfig
+
+	checkObjectExists  bool
+	checkObjectVersion bool
+	maxEventAge        time.Duration
+
+	ctx context.Context
+}
+
+// invokers has LambdaInvoker per target Lambda of retry.
+type invokers struct {
+	args argument
+	pool map[string]functions.LambdaInvoker
+}
+
+// get returns invoker of target of the record. Records scheduled without
+// retry_target are retried by the target Lambda of the stack.
+func (x *invokers) get(rec *functions.ErrorRecord) (functions.LambdaInvoker, string) {
+	target := rec.RetryTarget
+	if target == "" {
+		target = x.args.lambdaArn
+	}
+
+	invoker, ok := x.pool[target]
+	if !ok {
+		invoker = functions.NewLambdaInvoker(x.args.awsRegion, target)
+		x.pool[target] = invoker
+	}
+	return invoker, target
+}
+
+func retry(args argument, gates *gates, lease *retryLease, invokers *invokers, rec *functions.ErrorRecord) (bool, error) {
+	s3event, err := rec.RetryEvent(args.retryUnit)
+	if err != nil {
+		return false, err
+	}
+
+	invoker, target := invokers.get(rec)
+	gate, err := gates.get(target)
+	if err != nil {
+		return false, err
+	}
+	if err := gate.Allow(); err != nil {
+		return false, err
+	}
+
+	acquired, err := lease.acquire(rec)
+	if err != nil || !acquired {
+		return false, err
+	}
+
+	// Budget and probe are taken only for the leased record.
+	now := time.Now().UTC()
+	if err := gate.Take(rec.S3Key, now); err != nil {
+		if rerr := lease.rollback(rec, "Retry is not taken: "+err.Error()); rerr != nil {
+			logger.WithFields(logrus.Fields{
+				"error": rerr,
+				"s3key": rec.S3Key,
+			}).Error("Fail to rollback lease")
+		}
+		return false, err
+	}
+
+	logger.WithFields(logrus.Fields{
+		"s3key":       rec.S3Key,
+		"count":       rec.ErrorCount,
+		"nextRetryAt": time.Unix(rec.NextRetryAt, 0),
+		"target":      target,
+	}).Info("Invoking lambda")
+
+	requestID, err := invoker.InvokeEventWithID(args.ctx, *s3event)
+	if err != nil {
+		gate.Cancel(rec.S3Key, now)
+		if rerr := lease.rollback(rec, "Fail to invoke: "+err.Error()); rerr != nil {
+			// The record is recovered after expiry of the lease.
+			logger.WithFields(logrus.Fields{
+				"error": rerr,
+				"s3key": rec.S3Key,
+			}).Error("Fail to rollback lease")
+		}
+		return false, errors.Wrap(err, "Fail to invoke Lambda")
+	}
+
+	gate.Done(rec.S3Key, now)
+
+	released, err := lease.release(rec, requestID, target, now)
+	if err != nil {
+		// Invocation is done, then the record should not be retried by
+		// recovery. But it may happen and the target Lambda is invoked twice.
+		logger.WithFields(logrus.Fields{
+			"error": err,
+			"s3key": rec.S3Key,
+		}).Error("Fail to release lease")
+		return true, nil
+	}
+
+	if released.SuccessRequestID == requestID {
+		// Catcher received success of the retry before the release.
+		if err := lease.resolveEarlySuccess(released, s3event); err != nil {
+			logger.WithFields(logrus.Fields{
+				"error": err,
+				"s3key": rec.S3Key,
+			}).Error("Fail to resolve error record by success before release")
+		}
+		if err := gate.breaker.RecordRetrySuccess(args.ctx, rec.S3Key); err != nil {
+			logger.WithField("error", err).Error("Fail to record success of retry")
+		}
+	}
+
+	return true, nil
+}
+
+func handler(args argument) (result, error) {
+	var res result
+
+	if args.retryUnit != functions.RetryUnitObject && args.retryUnit != functions.RetryUnitGroup {
+		return res, errors.Errorf("Invalid RetryUnit: '%s'", args.retryUnit)
+	}
+
+	db := dynamo.New(session.New(), &aws.Config{Region: aws.String(args.awsRegion)})
+	table := db.Table(args.errorTable)
+	invokers := &invokers{args: args, pool: map[string]functions.LambdaInvoker{}}
+	lease := newRetryLease(args.ctx, table)
+	gates := &gates{args: args, pool: map[string]*retryGate{}}
+	checker := newStaleChecker(args)
+
+	recovered, err := lease.recoverExpired()
+	res.Recovered = recovered
+	if err != nil {
+		// Sweeping due records is still possible.
+		logger.WithField("error", err).Error("Fail to recover expired leases")
+	}
+
+	// Records that are not taken (paused, failed or leased by other Sweeper)
+	// stay in the index, then the query goes on from LastEvaluatedKey to
+	// reach records after them.
+	var startKey dynamo.PagingKey
+	for functions.HasTimeLeft(args.ctx) {
+		var records []functions.ErrorRecord
+		query := table.Get("retry_status", functions.RetryStatusScheduled).
+			Index(functions.RetryIndexName).
+			Range("next_retry_at", dynamo.LessOrEqual, time.Now().Unix()).
+			Limit(sweepBatchSize)
+		if startKey != nil {
+			query = query.StartFrom(startKey)
+		}
+
+		lastKey, err := query.AllWithLastEvaluatedKeyContext(args.ctx, &records)
+		if err != nil {
+			return res, errors.Wrap(err, "Fail to query due records")
+		}
+
+		for i := range records {
+			if !functions.HasTimeLeft(args.ctx) {
+				break
+			}
+
+			rec := &records[i]
+			obsolete, err := checker.resolveIfStale(table, rec, args.retryUnit)
+			if err != nil {
+				logger.WithFields(logrus.Fields{
+					"error": err,
+					"s3key": rec.S3Key,
+				}).Error("Fail to check staleness of error record")
+				res.Errors = append(res.Errors, errorInfo{S3Key: rec.S3Key, Error: err.Error()})
+				continue
+			}
+			if obsolete {
+				res.Obsolete = append(res.Obsolete, rec.S3Key)
+				continue
+			}
+
+			invoked, err := retry(args, gates, lease, invokers, rec)
+			if err == errRetryPaused {
+				// Records of other targets may be retried.
+				logger.WithFields(logrus.Fields{
+					"s3key":  rec.S3Key,
+					"target": rec.RetryTarget,
+				}).Warn("Retries are paused")
+				continue
+			}
+			if err != nil {
+				logger.WithFields(logrus.Fields{
+					"error": err,
+					"s3key": rec.S3Key,
+				}).Error("Fail to retry error record")
+				res.Errors = append(res.Errors, errorInfo{S3Key: rec.S3Key, Error: err.Error()})
+				continue
+			}
+
+			if invoked {
+				res.Invoked = append(res.Invoked, rec.S3Key)
+			}
+		}
+
+		// The index is exhausted.
+		if lastKey == nil {
+			break
+		}
+		startKey = lastKey
+	}
+
+	res.Circuits = gates.states()
+	logger.WithFields(logrus.Fields{
+		"circuits":  res.Circuits,
+		"invoked":   len(res.Invoked),
+		"obsolete":  len(res.Obsolete),
+		"recovered": len(res.Recovered),
+		"errors":    len(res.Errors),
+	}).Info("Done")
+
+	return res, nil
+}
+
+func main() {
+	lambda.Start(func(ctx context.Context) (result, error) {
+		logger = functions.SetLoggerContext(logger, ctx)
+
+		circuitConfig, err := functions.ParseCircuitConfig(
+			os.Getenv("CIRCUIT_FAILURE_RATE"),
+			os.Getenv("CIRCUIT_MIN_RETRIES"),
+			os.Getenv("CIRCUIT_WINDOW"),
+			os.Getenv("CIRCUIT_OPEN_DURATION"),
+			os.Getenv("CIRCUIT_PROBE_TIMEOUT"),
+			os.Getenv("RETRY_BUDGET_PER_HOUR"),
+		)
+		if err != nil {
+			return result{}, err
+		}
+
+		maxEventAge, err := strconv.ParseUint(os.Getenv("MAX_EVENT_AGE"), 10, 32)
+		if err != nil {
+			return result{}, errors.Wrapf(err, "Fail to parse MAX_EVENT_AGE: '%s'", os.Getenv("MAX_EVENT_AGE"))
+		}
+
+		args := argument{
+			errorTable:        os.Getenv("ERROR_TABLE"),
+			retryControlTable: os.Getenv("RETRY_CONTROL_TABLE"),
+			lambdaArn:         os.Getenv("TARGET_LAMBDA_ARN"),
+			awsRegion:         os.Getenv("AWS_REGION"),
+			retryUnit:         os.Getenv("RETRY_UNIT"),
+			circuitConfig:     circuitConfig,
+
+			checkObjectExists:  os.Getenv("CHECK_OBJECT_EXISTS") == "true",
+			checkObjectVersion: os.Getenv("CHECK_OBJECT_VERSION") == "true",
+			maxEventAge:        time.Duration(maxEventAge) * time.Second,
+
+			ctx: ctx,
+		}
+
+		return handler(args)
+	})
+}
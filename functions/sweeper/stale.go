@@ -0,0 +1,146 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/guregu/dynamo"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+
+	"github.com/m-mizutani/chamber/functions"
+)
+
+// staleChecker checks if retry of the record is still meaningful before
+// invocation. A retry of deleted, superseded or too old object fails or
+// processes outdated data, then the record is resolved as obsolete.
+type staleChecker struct {
+	ctx          context.Context
+	checkExists  bool
+	checkVersion bool
+	maxEventAge  time.Duration
+	s3svc        *s3.S3
+}
+
+func newStaleChecker(args argument) *staleChecker {
+	ssn := session.Must(session.NewSession(&aws.Config{Region: aws.String(args.awsRegion)}))
+
+	return &staleChecker{
+		ctx:          args.ctx,
+		checkExists:  args.checkObjectExists,
+		checkVersion: args.checkObjectVersion,
+		maxEventAge:  args.maxEventAge,
+		s3svc:        s3.New(ssn),
+	}
+}
+
+// enabled returns true if any check is configured.
+func (x *staleChecker) enabled() bool {
+	return x.checkExists || x.checkVersion || x.maxEventAge > 0
+}
+
+// Check returns a reason why retry of the S3 record is obsolete. An empty
+// reason means the record passed all checks.
+func (x *staleChecker) Check(s3record events.S3EventRecord) (string, error) {
+	if x.maxEventAge > 0 && !s3record.EventTime.IsZero() {
+		if age := time.Since(s3record.EventTime); age > x.maxEventAge {
+			return fmt.Sprintf("Event is older than %s", x.maxEventAge), nil
+		}
+	}
+
+	// The object of removal event is expected to be absent, and a delete
+	// marker has no object to compare.
+	if (!x.checkExists && !x.checkVersion) || strings.HasPrefix(s3record.EventName, "ObjectRemoved:") {
+		return "", nil
+	}
+
+	// Get the current object, not the version in the event, to find newer
+	// version.
+	head, err := x.s3svc.HeadObjectWithContext(x.ctx, &s3.HeadObjectInput{
+		Bucket: aws.String(s3record.S3.Bucket.Name),
+		Key:    aws.String(functions.DecodeObjectKey(s3record.S3.Object.Key)),
+	})
+	if err != nil {
+		if aerr, ok := err.(awserr.Error); ok && aerr.Code() == "NotFound" {
+			if x.checkExists {
+				return "Object was deleted", nil
+			}
+			return "", nil
+		}
+		return "", errors.Wrap(err, "Fail to get object metadata")
+	}
+
+	if !x.checkVersion {
+		return "", nil
+	}
+
+	object := s3record.S3.Object
+	if current := aws.StringValue(head.VersionId); object.VersionID != "" && current != "" {
+		if current != object.VersionID {
+			return fmt.Sprintf("Object was superseded by version %s", current), nil
+		}
+		return "", nil
+	}
+
+	if current := strings.Trim(aws.StringValue(head.ETag), `"`); object.ETag != "" && current != "" &&
+		current != strings.Trim(object.ETag, `"`) {
+		return fmt.Sprintf("Object was superseded, ETag %s", current), nil
+	}
+
+	return "", nil
+}
+
+// resolveIfStale checks the object of the record and resolves the record as
+// obsolete if the check fails. Retry of a group event that has multiple
+// objects is not checked because other objects may be still valid.
+func (x *staleChecker) resolveIfStale(table dynamo.Table, rec *functions.ErrorRecord, retryUnit string) (bool, error) {
+	if !x.enabled() {
+		return false, nil
+	}
+
+	s3event, err := rec.RetryEvent(retryUnit)
+	if err != nil {
+		return false, err
+	}
+	if len(s3event.Records) != 1 {
+		return false, nil
+	}
+
+	reason, err := x.Check(s3event.Records[0])
+	if err != nil || reason == "" {
+		return false, err
+	}
+
+	update, err := functions.Transit(table, rec, functions.StateResolved, "Obsolete: "+reason)
+	if err != nil {
+		return false, err
+	}
+
+	err = update.
+		Set("resolution", functions.ResolutionObsolete).
+		Set("resolved_at", time.Now().UTC()).
+		Remove("retry_status").
+		If("retry_status = ?", functions.RetryStatusScheduled).
+		RunWithContext(x.ctx)
+	if err != nil {
+		if functions.IsConditionalCheckFailed(err) {
+			// Taken by other Sweeper or modified by a new failure.
+			return false, nil
+		}
+		return false, errors.Wrap(err, "Fail to resolve obsolete error record")
+	}
+
+	logger.WithFields(logrus.Fields{
+		"s3key":  rec.S3Key,
+		"reason": reason,
+	}).Info("Resolved obsolete error record")
+
+	return true, nil
+}
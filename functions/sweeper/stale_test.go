@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/guregu/dynamo"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/m-mizutani/chamber/functions"
+)
+
+func newTestS3Record(eventName string, eventTime time.Time) events.S3EventRecord {
+	var s3record events.S3EventRecord
+	s3record.EventName = eventName
+	s3record.EventTime = eventTime
+	s3record.S3.Bucket.Name = "bucket"
+	s3record.S3.Object.Key = "dir/a.json"
+	return s3record
+}
+
+func TestStaleCheckerEnabled(t *testing.T) {
+	assert.False(t, (&staleChecker{}).enabled())
+	assert.True(t, (&staleChecker{checkExists: true}).enabled())
+	assert.True(t, (&staleChecker{checkVersion: true}).enabled())
+	assert.True(t, (&staleChecker{maxEventAge: time.Hour}).enabled())
+}
+
+func TestStaleCheckerEventAge(t *testing.T) {
+	checker := &staleChecker{ctx: context.Background(), maxEventAge: time.Hour}
+
+	reason, err := checker.Check(newTestS3Record("ObjectCreated:Put", time.Now().Add(-30*time.Minute)))
+	assert.NoError(t, err)
+	assert.Equal(t, "", reason)
+
+	reason, err = checker.Check(newTestS3Record("ObjectCreated:Put", time.Now().Add(-2*time.Hour)))
+	assert.NoError(t, err)
+	assert.Equal(t, "Event is older than 1h0m0s", reason)
+
+	// Event without time is not checked.
+	reason, err = checker.Check(newTestS3Record("ObjectCreated:Put", time.Time{}))
+	assert.NoError(t, err)
+	assert.Equal(t, "", reason)
+}
+
+func TestStaleCheckerObjectRemoved(t *testing.T) {
+	// The object of removal event is not checked, then S3 is not called.
+	checker := &staleChecker{ctx: context.Background(), checkExists: true, checkVersion: true}
+
+	reason, err := checker.Check(newTestS3Record("ObjectRemoved:Delete", time.Now()))
+	assert.NoError(t, err)
+	assert.Equal(t, "", reason)
+}
+
+func TestResolveIfStaleSkipsGroupEvent(t *testing.T) {
+	checker := &staleChecker{ctx: context.Background(), maxEventAge: time.Hour}
+	rec := &functions.ErrorRecord{
+		S3Key:      "bucket/dir/a.json",
+		S3Event:    []byte(`{"Records": [{"eventName": "ObjectCreated:Put"}]}`),
+		GroupEvent: []byte(`{"Records": [{"eventName": "ObjectCreated:Put"}, {"eventName": "ObjectCreated:Put"}]}`),
+	}
+
+	// Group event that has multiple objects is not checked.
+	obsolete, err := checker.resolveIfStale(dynamo.Table{}, rec, functions.RetryUnitGroup)
+	assert.NoError(t, err)
+	assert.False(t, obsolete)
+
+	// Disabled checker does not parse the event.
+	rec.S3Event = []byte("invalid")
+	obsolete, err = (&staleChecker{}).resolveIfStale(dynamo.Table{}, rec, functions.RetryUnitObject)
+	assert.NoError(t, err)
+	assert.False(t, obsolete)
+}
@@ -3,12 +3,15 @@ package functions
 import (
 	"context"
 	"encoding/json"
+	"strings"
+	"unicode/utf8"
 
 	"github.com/aws/aws-lambda-go/events"
 	"github.com/aws/aws-lambda-go/lambdacontext"
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/lambda"
+	"github.com/pkg/errors"
 
 	"github.com/sirupsen/logrus"
 )
@@ -31,7 +34,44 @@ func NewLambdaInvoker(region, lambdaArn string) LambdaInvoker {
 	return invoker
 }
 
-func (x *LambdaInvoker) Invoke(s3record events.S3EventRecord) error {
+func (x *LambdaInvoker) Invoke(ctx context.Context, s3record events.S3EventRecord) error {
+	return x.InvokeEvent(ctx, events.S3Event{[]events.S3EventRecord{s3record}})
+}
+
+// InvokeEvent invokes target Lambda asynchronously with S3 event that may
+// have multiple records.
+func (x *LambdaInvoker) InvokeEvent(ctx context.Context, ev events.S3Event) error {
+	_, err := x.InvokeEventWithID(ctx, ev)
+	return err
+}
+
+// InvokeEventWithID is same as InvokeEvent, and returns request ID of the
+// invocation. The request ID is also in invocation record of Lambda
+// Destinations of the target Lambda.
+func (x *LambdaInvoker) InvokeEventWithID(ctx context.Context, ev events.S3Event) (string, error) {
+	rawData, err := json.Marshal(ev)
+	if err != nil {
+		return "", err
+	}
+
+	input := &lambda.InvokeInput{
+		FunctionName:   aws.String(x.lambdaArn),
+		InvocationType: aws.String("Event"),
+		Payload:        rawData,
+	}
+
+	req, _ := x.svc.InvokeRequest(input)
+	req.SetContext(ctx)
+	if err := req.Send(); err != nil {
+		return "", err
+	}
+
+	return req.RequestID, nil
+}
+
+// InvokeSync invokes target Lambda with RequestResponse type and waits for
+// completion. An error returned by the target function is also returned.
+func (x *LambdaInvoker) InvokeSync(ctx context.Context, s3record events.S3EventRecord) error {
 	ev := events.S3Event{[]events.S3EventRecord{s3record}}
 	rawData, err := json.Marshal(ev)
 	if err != nil {
@@ -40,18 +80,74 @@ func (x *LambdaInvoker) Invoke(s3record events.S3EventRecord) error {
 
 	input := &lambda.InvokeInput{
 		FunctionName:   aws.String(x.lambdaArn),
-		InvocationType: aws.String("Event"),
+		InvocationType: aws.String("RequestResponse"),
 		Payload:        rawData,
 	}
 
-	_, err = x.svc.Invoke(input)
+	output, err := x.svc.InvokeWithContext(ctx, input)
 	if err != nil {
 		return err
 	}
 
+	if output.FunctionError != nil {
+		return &FunctionError{
+			Type:    aws.StringValue(output.FunctionError),
+			Payload: string(output.Payload),
+		}
+	}
+
 	return nil
 }
 
+// FunctionError is an error returned by target function in synchronous
+// invocation, not by Lambda service.
+type FunctionError struct {
+	Type    string
+	Payload string
+}
+
+func (x *FunctionError) Error() string {
+	return "Target function failed (" + x.Type + "): " + x.Payload
+}
+
+// CompareSequencer compares two sequencer values of S3 event for the same
+// object key. It returns -1 if a is older than b, 1 if a is newer than b and 0
+// if both are same. Sequencers are hexadecimal strings that can be compared
+// lexicographically after padding the shorter one with trailing zeros.
+func CompareSequencer(a, b string) int {
+	a, b = strings.ToUpper(a), strings.ToUpper(b)
+	if len(a) < len(b) {
+		a += strings.Repeat("0", len(b)-len(a))
+	} else if len(b) < len(a) {
+		b += strings.Repeat("0", len(a)-len(b))
+	}
+
+	return strings.Compare(a, b)
+}
+
+// TruncateString cuts s to at most n bytes at the start of a rune not to
+// break multibyte character.
+func TruncateString(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	for n > 0 && !utf8.RuneStart(s[n]) {
+		n--
+	}
+	return s[:n]
+}
+
+// SplitList splits comma separated list and removes spaces and empty items.
+func SplitList(s string) []string {
+	var list []string
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			list = append(list, v)
+		}
+	}
+	return list
+}
+
 func NewLogger() *logrus.Entry {
 	baseLogger := logrus.New()
 	baseLogger.SetLevel(logrus.InfoLevel)
@@ -0,0 +1,26 @@
+package functions
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCompareSequencer(t *testing.T) {
+	assert.Equal(t, 0, CompareSequencer("0055AED6DCD90281E5", "0055AED6DCD90281E5"))
+	assert.Equal(t, -1, CompareSequencer("0055AED6DCD90281E5", "0055AED6DCD90281E6"))
+	assert.Equal(t, 1, CompareSequencer("0055AED6DCD90281E6", "0055AED6DCD90281E5"))
+
+	// Case of hexadecimal digits is ignored.
+	assert.Equal(t, 0, CompareSequencer("0055aed6dcd90281e5", "0055AED6DCD90281E5"))
+
+	// Shorter one is padded with trailing zeros.
+	assert.Equal(t, 0, CompareSequencer("0055AED6DCD90281E5", "0055AED6DCD90281E500"))
+	assert.Equal(t, -1, CompareSequencer("0055AED6DCD90281E5", "0055AED6DCD90281E501"))
+	assert.Equal(t, 1, CompareSequencer("0055AED6DCD90281E6", "0055AED6DCD90281E5FF"))
+}
+
+func TestSplitList(t *testing.T) {
+	assert.Equal(t, []string{"a", "b"}, SplitList(" a, ,b "))
+	assert.Nil(t, SplitList(""))
+}
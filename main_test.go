@@ -140,6 +140,13 @@ type errorTableRecord struct {
 	S3Event      []byte    `dynamo:"s3event"`
 	ErrorCount   int       `dynamo:"error_count"`
 	Retried      bool      `dynamo:"retried"`
+	History      []struct {
+		ErrorMessage string `dynamo:"error_message"`
+		Attempt      int    `dynamo:"attempt"`
+	} `dynamo:"history"`
+	NextRetryAt int64  `dynamo:"next_retry_at"`
+	State       string `dynamo:"state"`
+	Version     int    `dynamo:"version"`
 }
 
 func TestFireDLQ(t *testing.T) {
@@ -185,6 +192,7 @@ func TestFireDLQ(t *testing.T) {
 			err := table.Get("s3key", key).One(&errRecord)
 			assert.NoError(t, err)
 			assert.Equal(t, "Test Error", errRecord.ErrorMessage)
+			assert.NotEmpty(t, errRecord.RequestID)
 
 			return true
 		}),
@@ -234,11 +242,15 @@ func TestCatcher(t *testing.T) {
 			err := table.Get("s3key", key).One(&errRecord)
 			assert.NoError(t, err)
 			assert.Equal(t, "Blue", errRecord.ErrorMessage)
+			assert.NotEmpty(t, errRecord.State)
+			assert.NotEqual(t, 0, errRecord.Version)
 
 			return true
 		}),
 
-		// Reloader recieves DynamoDB table change record
+		// Reloader recieves DynamoDB table change record and schedules retry.
+		// The update of schedule is also delivered to Reloader, but it is
+		// skipped without log of the key.
 		g.GetLambdaLogs(g.LogicalID("Reloader"), id, func(logs []string) bool {
 			assert.Equal(t, 1, len(logs))
 			return true
@@ -248,6 +260,51 @@ func TestCatcher(t *testing.T) {
 	g.Run()
 }
 
+func TestCatcherDecodedKey(t *testing.T) {
+	param := newParameter()
+	id := uuid.New().String()
+
+	bucketName := "test-bucket"
+	var s3Event events.S3Event
+	s3Event.Records = []events.S3EventRecord{
+		events.S3EventRecord{
+			S3: events.S3Entity{
+				Bucket: events.S3Bucket{Name: bucketName},
+				// URL encoded key as S3 event notification
+				Object: events.S3Object{Key: "encoded+dir/" + id + "%2Btest"},
+			},
+		},
+	}
+
+	s3Msg, err := json.Marshal(s3Event)
+	require.NoError(t, err)
+
+	attr := sns.MessageAttributeValue{}
+	attr.SetDataType("String")
+	attr.SetStringValue("Blue")
+	snsAttrs := map[string]*sns.MessageAttributeValue{
+		"ErrorMessage": &attr,
+	}
+
+	g := generalprobe.New(param.AwsRegion, param.StackName)
+	g.AddScenes([]generalprobe.Scene{
+		g.PublishSnsMessage(g.Arn(param.DlqSnsArn), s3Msg).AddMessageAttributes(snsAttrs),
+
+		g.GetDynamoRecord(g.LogicalID("ErrorTable"), func(table dynamo.Table) bool {
+			var errRecord errorTableRecord
+			key := bucketName + "/encoded dir/" + id + "+test"
+
+			err := table.Get("s3key", key).One(&errRecord)
+			assert.NoError(t, err)
+			assert.Equal(t, "Blue", errRecord.ErrorMessage)
+
+			return true
+		}),
+	})
+
+	g.Run()
+}
+
 func TestCountUp(t *testing.T) {
 	param := newParameter()
 	id := uuid.New().String()
@@ -291,16 +348,23 @@ func TestCountUp(t *testing.T) {
 			return true
 		}),
 
-		g.GetLambdaLogs(g.LogicalID("Reloader"), id, func(logs []string) bool {
-			assert.Equal(t, 1, len(logs))
-			return true
+		g.GetDynamoRecord(g.LogicalID("ErrorTable"), func(table dynamo.Table) bool {
+			var errRecord errorTableRecord
+			key := bucketName + "/" + id
+
+			err := table.Get("s3key", key).One(&errRecord)
+			assert.NoError(t, err)
+
+			// Reloader scheduled retry, or Sweeper already took the record.
+			return errRecord.NextRetryAt > 0
 		}),
 
-		// Target Lambda should be invoked for first time.
+		// Target Lambda should be invoked for first time by Sweeper after
+		// backoff delay.
 		g.GetLambdaLogs(g.Arn(param.LambdaArn), id, func(logs []string) bool {
 			assert.Equal(t, 1, len(logs))
 			return true
-		}),
+		}).SetInterval(15).SetQueryLimit(20),
 
 		// Send second (dummy) DLQ message, then error_count should be count up.
 		g.PublishSnsMessage(g.Arn(param.DlqSnsArn), s3Msg).AddMessageAttributes(snsAttrs),
@@ -315,6 +379,13 @@ func TestCountUp(t *testing.T) {
 				return false
 			}
 
+			// History has both of failures.
+			if 2 != len(errRecord.History) {
+				return false
+			}
+			assert.Equal(t, 1, errRecord.History[0].Attempt)
+			assert.Equal(t, 2, errRecord.History[1].Attempt)
+
 			return true
 		}),
 